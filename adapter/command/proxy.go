@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,10 +13,12 @@ import (
 
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/app"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/logger"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/routes"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/watch"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/watch/cert"
 	watchConfig "github.com/oidc-proxy-ecosystem/oidc-proxy/watch/config"
 	"github.com/urfave/cli/v2"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -78,6 +81,21 @@ func ProxyAction(configFilename string) error {
 			}
 		}()
 	}
+	var extAuthz *grpc.Server
+	if appConf.ExtAuthz.IsEnabled() {
+		extAuthz = grpc.NewServer()
+		routes.NewExtAuthzServer(multiHost).Register(extAuthz)
+		l, err := net.Listen("tcp", appConf.ExtAuthz.GetAddr())
+		if err != nil {
+			return err
+		}
+		logger.Log.Info(fmt.Sprintf("ext_authz listening on %s", appConf.ExtAuthz.GetAddr()))
+		go func() {
+			if err := extAuthz.Serve(l); err != nil {
+				logger.Log.Error(err)
+			}
+		}()
+	}
 	signals := []os.Signal{
 		syscall.SIGINT,
 		syscall.SIGQUIT,
@@ -97,6 +115,9 @@ func ProxyAction(configFilename string) error {
 			}
 		}
 	})
+	if extAuthz != nil {
+		extAuthz.GracefulStop()
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
 	defer cancel()
 	return s.Shutdown(ctx)
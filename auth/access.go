@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+)
+
+// ErrAccessDenied アクセス制御の条件を満たさなかった場合のエラーです。
+var ErrAccessDenied = errors.New("access denied")
+
+// Claims アクセス制御の判定に使用するトークンのクレームです。
+type Claims map[string]interface{}
+
+// Lookup クレームの値を返します。pathは.で区切ることでネストしたクレームを参照できます。
+// .を含むクレーム名(例: https://example.com/roles)はそのままのキーが優先されます。
+func (c Claims) Lookup(path string) (interface{}, bool) {
+	if v, ok := c[path]; ok {
+		return v, true
+	}
+	for i := 0; i < len(path); i++ {
+		if path[i] != '.' {
+			continue
+		}
+		if nested, ok := c[path[:i]].(map[string]interface{}); ok {
+			if v, ok := Claims(nested).Lookup(path[i+1:]); ok {
+				return v, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Strings クレームの値を文字列の配列として返します。
+func (c Claims) Strings(path string) []string {
+	v, ok := c.Lookup(path)
+	if !ok {
+		return nil
+	}
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Scopes トークンのscope(スペース区切り)またはscp(配列)クレームを返します。
+func (c Claims) Scopes() []string {
+	if scope, ok := c["scope"].(string); ok {
+		return strings.Fields(scope)
+	}
+	return c.Strings("scp")
+}
+
+// Authorize 全てのアクセス制御の条件を満たすかを判定します。
+// scopesは付与されたスコープで、トークンにscopeクレームが無い場合に使用されます。
+func Authorize(rules []config.Access, claims Claims, scopes []string) error {
+	if tokenScopes := claims.Scopes(); len(tokenScopes) > 0 {
+		scopes = tokenScopes
+	}
+	for _, rule := range rules {
+		if err := authorize(rule, claims, scopes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func authorize(rule config.Access, claims Claims, scopes []string) error {
+	if len(rule.Groups) > 0 && !containsAny(claims.Strings(rule.GetGroupsClaim()), rule.Groups) {
+		return fmt.Errorf("%w: not a member of the required groups", ErrAccessDenied)
+	}
+	if len(rule.Roles) > 0 && !containsAny(claims.Strings(rule.GetRolesClaim()), rule.Roles) {
+		return fmt.Errorf("%w: missing the required roles", ErrAccessDenied)
+	}
+	if len(rule.EmailDomains) > 0 && !allowedEmail(claims, rule.EmailDomains, rule.AllowUnverifiedEmail) {
+		return fmt.Errorf("%w: email domain is not allowed", ErrAccessDenied)
+	}
+	if len(rule.Subjects) > 0 && !containsAny(claims.Strings("sub"), rule.Subjects) {
+		return fmt.Errorf("%w: subject is not allowed", ErrAccessDenied)
+	}
+	for _, scope := range rule.Scopes {
+		if !containsAny(scopes, []string{scope}) {
+			return fmt.Errorf("%w: missing the required scope %s", ErrAccessDenied, scope)
+		}
+	}
+	return nil
+}
+
+// emailVerified email_verifiedがtrueかを返します。Cognitoなど文字列の"true"を返すIdPにも対応します。
+func emailVerified(claims Claims) bool {
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		return v
+	case string:
+		return strings.EqualFold(v, "true")
+	}
+	return false
+}
+
+// allowedEmail メールアドレスのドメインが許可されているかを返します。
+// email_verifiedが含まれない場合は、allow_unverified_emailが設定されていない限り未確認のメールアドレスとして扱います。
+func allowedEmail(claims Claims, domains []string, allowUnverified bool) bool {
+	if !emailVerified(claims) && !allowUnverified {
+		return false
+	}
+	email, _ := claims["email"].(string)
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return false
+	}
+	domain := email[i+1:]
+	for _, d := range domains {
+		if strings.EqualFold(domain, strings.TrimPrefix(d, "@")) {
+			return true
+		}
+	}
+	return false
+}
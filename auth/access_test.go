@@ -0,0 +1,71 @@
+package auth_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/auth"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorize(t *testing.T) {
+	var claims auth.Claims
+	err := json.Unmarshal([]byte(`{
+		"sub": "user-1",
+		"email": "alice@example.com",
+		"email_verified": true,
+		"groups": ["developers"],
+		"realm_access": {"roles": ["admin", "viewer"]},
+		"https://example.com/roles": ["operator"],
+		"scope": "openid email"
+	}`), &claims)
+	if !assert.NoError(t, err) {
+		return
+	}
+	tests := []struct {
+		name    string
+		rule    config.Access
+		allowed bool
+	}{
+		{name: "groups", rule: config.Access{Groups: []string{"admins", "developers"}}, allowed: true},
+		{name: "groups not matched", rule: config.Access{Groups: []string{"admins"}}, allowed: false},
+		{name: "nested roles", rule: config.Access{Roles: []string{"admin"}, RolesClaim: "realm_access.roles"}, allowed: true},
+		{name: "namespaced roles", rule: config.Access{Roles: []string{"operator"}, RolesClaim: "https://example.com/roles"}, allowed: true},
+		{name: "email domain", rule: config.Access{EmailDomains: []string{"Example.com"}}, allowed: true},
+		{name: "email domain not matched", rule: config.Access{EmailDomains: []string{"example.org"}}, allowed: false},
+		{name: "subjects", rule: config.Access{Subjects: []string{"user-2"}}, allowed: false},
+		{name: "scopes", rule: config.Access{Scopes: []string{"openid", "email"}}, allowed: true},
+		{name: "missing scope", rule: config.Access{Scopes: []string{"openid", "profile"}}, allowed: false},
+		{name: "all conditions", rule: config.Access{Groups: []string{"developers"}, Subjects: []string{"user-2"}}, allowed: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := auth.Authorize([]config.Access{tt.rule}, claims, nil)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, auth.ErrAccessDenied))
+			}
+		})
+	}
+}
+
+func TestAuthorizeUnverifiedEmail(t *testing.T) {
+	// email_verifiedを含まないIdPのメールアドレスは未確認として扱う
+	claims := auth.Claims{"sub": "user-1", "email": "alice@example.com"}
+	rule := config.Access{EmailDomains: []string{"example.com"}}
+	assert.True(t, errors.Is(auth.Authorize([]config.Access{rule}, claims, nil), auth.ErrAccessDenied))
+	claims["email_verified"] = false
+	assert.True(t, errors.Is(auth.Authorize([]config.Access{rule}, claims, nil), auth.ErrAccessDenied))
+	claims["email_verified"] = "false"
+	assert.True(t, errors.Is(auth.Authorize([]config.Access{rule}, claims, nil), auth.ErrAccessDenied))
+	// Cognitoなどは文字列で返却する
+	claims["email_verified"] = "true"
+	assert.NoError(t, auth.Authorize([]config.Access{rule}, claims, nil))
+
+	claims["email_verified"] = false
+	rule.AllowUnverifiedEmail = true
+	assert.NoError(t, auth.Authorize([]config.Access{rule}, claims, nil))
+}
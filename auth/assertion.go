@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+	"golang.org/x/oauth2"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// ClientAssertionType JWTによるクライアント認証のclient_assertion_typeです(RFC 7523)。
+const ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// clientAssertionLifetime クライアント認証のJWTの有効期間です。
+const clientAssertionLifetime = 5 * time.Minute
+
+var errNoPrivateKey = errors.New("private_key_jwt: private key is not loaded")
+
+// clientAssertion client_secret_jwtまたはprivate_key_jwtのクライアント認証に使用するJWTを生成します。
+type clientAssertion struct {
+	method   string
+	clientID string
+	secret   string
+	keyID    string
+	// privateKey ファイルの更新に追従するため、署名の度に取得します。
+	privateKey func() crypto.Signer
+}
+
+func newClientAssertion(oidcConf config.Oidc, privateKey func() crypto.Signer) *clientAssertion {
+	if !oidcConf.IsClientAssertion() {
+		return nil
+	}
+	return &clientAssertion{
+		method:     oidcConf.TokenEndpointAuthMethod,
+		clientID:   oidcConf.ClientId,
+		secret:     oidcConf.ClientSecret,
+		keyID:      oidcConf.PrivateKeyId,
+		privateKey: privateKey,
+	}
+}
+
+// sign audience(トークンエンドポイント)宛のクライアント認証のJWTを生成します。
+func (c *clientAssertion) sign(audience string) (string, error) {
+	key, err := c.signingKey()
+	if err != nil {
+		return "", err
+	}
+	signer, err := jose.NewSigner(key, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+	jti, err := randomID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return jwt.Signed(signer).Claims(jwt.Claims{
+		Issuer:   c.clientID,
+		Subject:  c.clientID,
+		Audience: jwt.Audience{audience},
+		ID:       jti,
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(clientAssertionLifetime)),
+	}).CompactSerialize()
+}
+
+func (c *clientAssertion) signingKey() (jose.SigningKey, error) {
+	if c.method == config.ClientSecretJwt {
+		return jose.SigningKey{Algorithm: jose.HS256, Key: []byte(c.secret)}, nil
+	}
+	var privateKey crypto.Signer
+	if c.privateKey != nil {
+		privateKey = c.privateKey()
+	}
+	if privateKey == nil {
+		return jose.SigningKey{}, errNoPrivateKey
+	}
+	var alg jose.SignatureAlgorithm
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		alg = jose.RS256
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			alg = jose.ES256
+		case elliptic.P384():
+			alg = jose.ES384
+		case elliptic.P521():
+			alg = jose.ES512
+		default:
+			return jose.SigningKey{}, fmt.Errorf("private_key_jwt: unsupported curve %s", key.Curve.Params().Name)
+		}
+	case ed25519.PrivateKey:
+		alg = jose.EdDSA
+	default:
+		return jose.SigningKey{}, fmt.Errorf("private_key_jwt: unsupported key type %T", privateKey)
+	}
+	return jose.SigningKey{
+		Algorithm: alg,
+		Key: jose.JSONWebKey{
+			Key:   privateKey,
+			KeyID: c.keyID,
+		},
+	}, nil
+}
+
+// params トークンリクエストへ付与するクライアント認証のパラメータを返します。
+func (c *clientAssertion) params(tokenURL string) (url.Values, error) {
+	assertion, err := c.sign(tokenURL)
+	if err != nil {
+		return nil, err
+	}
+	return url.Values{
+		"client_id":             {c.clientID},
+		"client_assertion_type": {ClientAssertionType},
+		"client_assertion":      {assertion},
+	}, nil
+}
+
+// authCodeOptions 認可コードの交換へ付与するクライアント認証のパラメータを返します。
+func (c *clientAssertion) authCodeOptions(tokenURL string) ([]oauth2.AuthCodeOption, error) {
+	params, err := c.params(tokenURL)
+	if err != nil {
+		return nil, err
+	}
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("client_assertion_type", params.Get("client_assertion_type")),
+		oauth2.SetAuthURLParam("client_assertion", params.Get("client_assertion")),
+	}, nil
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
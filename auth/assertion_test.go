@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestClientSecretJwtAssertion(t *testing.T) {
+	const tokenURL = "https://idp.example.com/oauth/token"
+	assertion := newClientAssertion(config.Oidc{
+		ClientId:                "client",
+		ClientSecret:            "secret",
+		TokenEndpointAuthMethod: config.ClientSecretJwt,
+	}, nil)
+	params, err := assertion.params(tokenURL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "client", params.Get("client_id"))
+	assert.Equal(t, ClientAssertionType, params.Get("client_assertion_type"))
+
+	token, err := jwt.ParseSigned(params.Get("client_assertion"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	var claims jwt.Claims
+	if !assert.NoError(t, token.Claims([]byte("secret"), &claims)) {
+		return
+	}
+	assert.NoError(t, claims.Validate(jwt.Expected{
+		Issuer:   "client",
+		Subject:  "client",
+		Audience: jwt.Audience{tokenURL},
+	}))
+	assert.NotEmpty(t, claims.ID)
+
+	// 署名の度にjtiは異なる
+	next, err := assertion.params(tokenURL)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEqual(t, params.Get("client_assertion"), next.Get("client_assertion"))
+}
+
+func TestPrivateKeyJwtAssertionWithoutKey(t *testing.T) {
+	assertion := newClientAssertion(config.Oidc{
+		ClientId:                "client",
+		TokenEndpointAuthMethod: config.PrivateKeyJwt,
+		PrivateKey:              "client.pem",
+	}, nil)
+	_, err := assertion.params("https://idp.example.com/oauth/token")
+	assert.Equal(t, errNoPrivateKey, err)
+}
@@ -2,7 +2,10 @@ package auth
 
 import (
 	"context"
+	"crypto"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
 
@@ -15,36 +18,258 @@ type Authenticator struct {
 	Provider *oidc.Provider
 	Config   oauth2.Config
 	Ctx      context.Context
+	Issuer   string
+	jwksURL  string
+	keySet   *remoteKeySet
+	// assertion client_secret_jwtまたはprivate_key_jwtの場合のクライアント認証
+	assertion *clientAssertion
+	// userInfoURL ユーザー情報を取得するエンドポイント(OIDCの場合はディスカバリ情報の値)
+	userInfoURL  string
+	subjectClaim string
+	// introspectionURL アクセストークンのイントロスペクションを行うエンドポイント
+	introspectionURL string
+	introspection    *introspectionCache
+	// tokenLifetime expires_inが返却されない場合のアクセストークンの有効期限
+	tokenLifetime time.Duration
+	// signingAlgs IDトークンの署名アルゴリズム(未設定の場合はRS256)
+	signingAlgs []string
+	// logoutTokens 受け付けたログアウトトークンのjti
+	logoutTokens *jtiCache
 }
 
-func (a *Authenticator) setValue(url.Values) {
+// Verifier キャッシュしたJWKSを使用してトークンを検証するVerifierを返します。
+// 署名アルゴリズムが指定されない場合は、ディスカバリ情報のid_token_signing_alg_values_supportedを使用します。
+func (a *Authenticator) Verifier(config *oidc.Config) *oidc.IDTokenVerifier {
+	if len(config.SupportedSigningAlgs) == 0 && len(a.signingAlgs) > 0 {
+		c := *config
+		c.SupportedSigningAlgs = a.signingAlgs
+		config = &c
+	}
+	return oidc.NewVerifier(a.Issuer, a.keySet, config)
+}
 
+// supportedSigningAlgs 検証に使用できる署名アルゴリズムです。共通鍵によるHS256などは含みません。
+var supportedSigningAlgs = map[string]bool{
+	oidc.RS256: true,
+	oidc.RS384: true,
+	oidc.RS512: true,
+	oidc.ES256: true,
+	oidc.ES384: true,
+	oidc.ES512: true,
+	oidc.PS256: true,
+	oidc.PS384: true,
+	oidc.PS512: true,
+	"EdDSA":    true,
 }
 
-func NewAuthenticator(ctx context.Context, oidcConf config.Oidc) (*Authenticator, error) {
+// signingAlgs ディスカバリ情報の署名アルゴリズムのうち、検証に使用できるものを返します。
+func signingAlgs(algs []string) []string {
+	var supported []string
+	for _, alg := range algs {
+		if supportedSigningAlgs[alg] {
+			supported = append(supported, alg)
+		}
+	}
+	return supported
+}
+
+func newAuthenticator(ctx context.Context, oidcConf config.Oidc, prev *Authenticator, privateKey func() crypto.Signer) (*Authenticator, error) {
+	// イントロスペクションの結果と受け付けたログアウトトークンはディスカバリ情報の更新後も引き継ぐ
+	var introspection *introspectionCache
+	var logoutTokens *jtiCache
+	if prev != nil {
+		introspection = prev.introspection
+		logoutTokens = prev.logoutTokens
+	} else {
+		introspection = newIntrospectionCache(oidcConf.GetIntrospectionCacheTtl())
+		logoutTokens = newJtiCache()
+	}
+	if oidcConf.IsOAuth2() {
+		// OAuth2のプロバイダはディスカバリ情報を持たないため、設定されたエンドポイントを使用する
+		return &Authenticator{
+			Config: newOAuth2Config(oidcConf, oauth2.Endpoint{
+				AuthURL:  oidcConf.AuthorizeUrl,
+				TokenURL: oidcConf.TokenUrl,
+			}),
+			Ctx:              ctx,
+			userInfoURL:      oidcConf.UserinfoUrl,
+			subjectClaim:     oidcConf.GetSubjectClaim(),
+			assertion:        newClientAssertion(oidcConf, privateKey),
+			introspectionURL: oidcConf.IntrospectionUrl,
+			introspection:    introspection,
+			tokenLifetime:    oidcConf.GetDefaultTokenLifetime(),
+		}, nil
+	}
 	provider, err := oidc.NewProvider(ctx, oidcConf.Provider)
 	if err != nil {
 		return nil, err
 	}
-	var o2conf oauth2.Config
-	o2conf = oauth2.Config{
+	var discovery struct {
+		Issuer                string   `json:"issuer"`
+		JWKSURL               string   `json:"jwks_uri"`
+		IntrospectionEndpoint string   `json:"introspection_endpoint"`
+		UserInfoEndpoint      string   `json:"userinfo_endpoint"`
+		SigningAlgs           []string `json:"id_token_signing_alg_values_supported"`
+	}
+	if err := provider.Claims(&discovery); err != nil {
+		return nil, err
+	}
+	var keySet *remoteKeySet
+	if prev != nil && prev.jwksURL == discovery.JWKSURL {
+		keySet = prev.keySet
+	} else {
+		keySet = newRemoteKeySet(ctx, discovery.JWKSURL)
+	}
+	introspectionURL := oidcConf.IntrospectionUrl
+	if introspectionURL == "" {
+		introspectionURL = discovery.IntrospectionEndpoint
+	}
+	userInfoURL := oidcConf.UserinfoUrl
+	if userInfoURL == "" {
+		userInfoURL = discovery.UserInfoEndpoint
+	}
+	return &Authenticator{
+		Provider:         provider,
+		Config:           newOAuth2Config(oidcConf, provider.Endpoint()),
+		Ctx:              ctx,
+		Issuer:           discovery.Issuer,
+		jwksURL:          discovery.JWKSURL,
+		keySet:           keySet,
+		assertion:        newClientAssertion(oidcConf, privateKey),
+		userInfoURL:      userInfoURL,
+		subjectClaim:     "sub",
+		introspectionURL: introspectionURL,
+		introspection:    introspection,
+		tokenLifetime:    oidcConf.GetDefaultTokenLifetime(),
+		signingAlgs:      signingAlgs(discovery.SigningAlgs),
+		logoutTokens:     logoutTokens,
+	}, nil
+}
+
+func newOAuth2Config(oidcConf config.Oidc, endpoint oauth2.Endpoint) oauth2.Config {
+	o2conf := oauth2.Config{
 		ClientID:     oidcConf.ClientId,
 		ClientSecret: oidcConf.ClientSecret,
 		RedirectURL:  oidcConf.RedirectUrl,
-		Endpoint:     provider.Endpoint(),
+		Endpoint:     endpoint,
 		Scopes:       oidcConf.Scopes,
 	}
+	switch oidcConf.TokenEndpointAuthMethod {
+	case config.ClientSecretBasic:
+		o2conf.Endpoint.AuthStyle = oauth2.AuthStyleInHeader
+	case config.ClientSecretPost:
+		o2conf.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	case config.ClientSecretJwt, config.PrivateKeyJwt:
+		// client_idのみをパラメータで送信し、シークレットはJWTの署名にのみ使用する
+		o2conf.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+		o2conf.ClientSecret = ""
+	}
+	return o2conf
+}
 
-	return &Authenticator{
-		Provider: provider,
-		Config:   o2conf,
-		Ctx:      ctx,
-	}, nil
+// Exchange 認可コードをトークンへ交換します。
+func (a *Authenticator) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	if a.assertion != nil {
+		assertionOpts, err := a.assertion.authCodeOptions(a.Config.Endpoint.TokenURL)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, assertionOpts...)
+	}
+	return a.withExpiry(a.Config.Exchange(ctx, code, opts...))
+}
+
+// Refresh リフレッシュトークンでトークンを更新します。
+func (a *Authenticator) Refresh(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+	if a.assertion == nil {
+		return a.withExpiry(a.Config.TokenSource(ctx, &oauth2.Token{
+			RefreshToken: refreshToken,
+		}).Token())
+	}
+	return a.withExpiry(a.tokenRequest(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	}))
+}
+
+// withExpiry expires_inが返却されなかったトークンにdefault_token_lifetimeの有効期限を設定します。
+// 有効期限のないトークンでセッションが無期限に有効とならないよう、期限後は更新または再ログインを行います。
+func (a *Authenticator) withExpiry(token *oauth2.Token, err error) (*oauth2.Token, error) {
+	if err != nil {
+		return nil, err
+	}
+	if token.Expiry.IsZero() && a.tokenLifetime > 0 {
+		token.Expiry = time.Now().Add(a.tokenLifetime)
+	}
+	return token, nil
 }
 
+// SetTokenSession トークンレスポンスをセッションへ保存します。
+// 更新時にIDトークンやリフレッシュトークンが返却されなかった場合は、保存済みの値を維持します。
 func SetTokenSession(session *sessions.Session, token *oauth2.Token) {
-	rawIdToken, _ := token.Extra("id_token").(string)
-	session.Values["id_token"] = rawIdToken
+	if rawIdToken, _ := token.Extra("id_token").(string); rawIdToken != "" {
+		session.Values["id_token"] = rawIdToken
+	}
 	session.Values["access_token"] = token.AccessToken
-	session.Values["refresh_token"] = token.RefreshToken
+	if token.RefreshToken != "" {
+		session.Values["refresh_token"] = token.RefreshToken
+	}
+	// scopeが返却されない場合は要求時と同じスコープが付与されている
+	if scope, _ := token.Extra("scope").(string); scope != "" {
+		session.Values["scope"] = scope
+	}
+	if !token.Expiry.IsZero() {
+		session.Values["expiry"] = token.Expiry.Unix()
+	}
+}
+
+// SetIDTokenExpiry セッションが保持するIDトークンの有効期限を保存します。
+func SetIDTokenExpiry(session *sessions.Session, expiry time.Time) {
+	delete(session.Values, "id_token_stale")
+	if expiry.IsZero() {
+		delete(session.Values, "id_token_expiry")
+	} else {
+		session.Values["id_token_expiry"] = expiry.Unix()
+	}
+}
+
+// SetIDTokenStale 更新時にIDトークンが再発行されなかったことを記録します。
+// 以降はIDトークンの有効期限による更新を行いません。
+func SetIDTokenStale(session *sessions.Session) {
+	session.Values["id_token_stale"] = true
+}
+
+// IDTokenStale 更新時にIDトークンが再発行されなかったかを返します。
+func IDTokenStale(session *sessions.Session) bool {
+	stale, _ := session.Values["id_token_stale"].(bool)
+	return stale
+}
+
+// TokenExpiry セッションが保持するアクセストークンの有効期限を返します。
+func TokenExpiry(session *sessions.Session) time.Time {
+	return sessionTime(session, "expiry")
+}
+
+// IDTokenExpiry セッションが保持するIDトークンの有効期限を返します。
+func IDTokenExpiry(session *sessions.Session) time.Time {
+	return sessionTime(session, "id_token_expiry")
+}
+
+// GrantedScopes セッションが保持するトークンに付与されたスコープを返します。
+func GrantedScopes(session *sessions.Session, requested []string) []string {
+	if scope, _ := session.Values["scope"].(string); scope != "" {
+		return strings.Fields(scope)
+	}
+	return requested
+}
+
+func sessionTime(session *sessions.Session, key string) time.Time {
+	// セッションストアはJSONで保存するため、読込後の数値はfloat64になる
+	switch v := session.Values[key].(type) {
+	case int64:
+		return time.Unix(v, 0)
+	case float64:
+		return time.Unix(int64(v), 0)
+	}
+	return time.Time{}
 }
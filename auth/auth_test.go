@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// ecdsaIdP ES256で署名するIdPのディスカバリ情報とJWKSを返すテスト用のサーバーです。
+type ecdsaIdP struct {
+	*httptest.Server
+	key *ecdsa.PrivateKey
+}
+
+func newECDSAIdP(t *testing.T, algs []string) *ecdsaIdP {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	idp := &ecdsaIdP{key: key}
+	idp.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/jwks" {
+			json.NewEncoder(w).Encode(&jose.JSONWebKeySet{
+				Keys: []jose.JSONWebKey{{Key: key.Public(), KeyID: "ec", Algorithm: "ES256"}},
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": algs,
+		})
+	}))
+	return idp
+}
+
+func (i *ecdsaIdP) sign(t *testing.T, claims map[string]interface{}) string {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: i.key}, (&jose.SignerOptions{}).WithHeader("kid", "ec"))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	payload, _ := json.Marshal(claims)
+	object, err := signer.Sign(payload)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	token, _ := object.CompactSerialize()
+	return token
+}
+
+func TestVerifierSigningAlgs(t *testing.T) {
+	idp := newECDSAIdP(t, []string{"ES256", "HS256"})
+	defer idp.Close()
+	authenticator, err := newAuthenticator(context.Background(), config.Oidc{Provider: idp.URL, ClientId: "client"}, nil, nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	// 共通鍵のアルゴリズムは検証に使用しない
+	assert.Equal(t, []string{"ES256"}, authenticator.signingAlgs)
+	rawIDToken := idp.sign(t, map[string]interface{}{
+		"iss": idp.URL,
+		"aud": "client",
+		"sub": "user",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	_, err = authenticator.Verifier(&oidc.Config{ClientID: "client"}).Verify(context.Background(), rawIDToken)
+	assert.NoError(t, err)
+}
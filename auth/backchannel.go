@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+)
+
+// BackchannelLogoutEvent ログアウトトークンのeventsクレームに含まれるイベント名です。
+const BackchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+var errInvalidLogoutToken = errors.New("invalid logout token")
+
+// logoutTokenTTL expを含まないログアウトトークンをiatから受け付ける期間です。
+const logoutTokenTTL = 5 * time.Minute
+
+// LogoutToken Back-Channel Logoutで受け取ったログアウトトークンです。
+type LogoutToken struct {
+	Subject   string
+	SessionID string
+}
+
+// VerifyLogoutToken Back-Channel Logoutのログアウトトークンを検証します。
+// 署名・iss・audに加えて、eventsクレーム、sidまたはsubの存在、nonceが含まれないことを確認します。
+// 同じjtiのログアウトトークンは有効期間内に一度だけ受け付けます。
+func (a *Authenticator) VerifyLogoutToken(ctx context.Context, rawToken string) (*LogoutToken, error) {
+	if a.IsOAuth2() {
+		return nil, errors.New("logout token: provider does not issue id tokens")
+	}
+	// ログアウトトークンはexpを含まない場合があるため、有効期限は個別に判定する
+	token, err := a.Verifier(&oidc.Config{
+		ClientID:        a.Config.ClientID,
+		SkipExpiryCheck: true,
+	}).Verify(ctx, rawToken)
+	if err != nil {
+		return nil, err
+	}
+	var claims struct {
+		Sid    string                     `json:"sid"`
+		Jti    string                     `json:"jti"`
+		Nonce  *json.RawMessage           `json:"nonce"`
+		Events map[string]json.RawMessage `json:"events"`
+	}
+	if err := token.Claims(&claims); err != nil {
+		return nil, err
+	}
+	if !token.Expiry.IsZero() && time.Now().After(token.Expiry) {
+		return nil, fmt.Errorf("%w: token is expired", errInvalidLogoutToken)
+	}
+	if token.IssuedAt.IsZero() {
+		return nil, fmt.Errorf("%w: missing iat", errInvalidLogoutToken)
+	}
+	expiry := token.Expiry
+	if expiry.IsZero() {
+		expiry = token.IssuedAt.Add(logoutTokenTTL)
+		if time.Now().After(expiry) {
+			return nil, fmt.Errorf("%w: token is expired", errInvalidLogoutToken)
+		}
+	}
+	event, ok := claims.Events[BackchannelLogoutEvent]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing back-channel logout event", errInvalidLogoutToken)
+	}
+	var v map[string]interface{}
+	if err := json.Unmarshal(event, &v); err != nil || v == nil {
+		return nil, fmt.Errorf("%w: back-channel logout event must be a JSON object", errInvalidLogoutToken)
+	}
+	if claims.Nonce != nil {
+		return nil, fmt.Errorf("%w: nonce is not allowed", errInvalidLogoutToken)
+	}
+	if claims.Sid == "" && token.Subject == "" {
+		return nil, fmt.Errorf("%w: missing sid and sub", errInvalidLogoutToken)
+	}
+	if claims.Jti == "" {
+		return nil, fmt.Errorf("%w: missing jti", errInvalidLogoutToken)
+	}
+	// 再送されたログアウトトークンは拒否する
+	if !a.logoutTokens.add(claims.Jti, expiry) {
+		return nil, fmt.Errorf("%w: token is already used", errInvalidLogoutToken)
+	}
+	return &LogoutToken{
+		Subject:   token.Subject,
+		SessionID: claims.Sid,
+	}, nil
+}
+
+// maxJtiEntries 保持するjtiの上限です。
+const maxJtiEntries = 10000
+
+// jtiCache 受け付けたトークンのjtiを有効期限まで保持します。
+type jtiCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func newJtiCache() *jtiCache {
+	return &jtiCache{
+		entries: map[string]time.Time{},
+	}
+}
+
+// add jtiを登録します。有効期限内に登録済みのjtiの場合はfalseを返します。
+func (c *jtiCache) add(jti string, expires time.Time) bool {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if exp, ok := c.entries[jti]; ok && now.Before(exp) {
+		return false
+	}
+	if len(c.entries) >= maxJtiEntries {
+		for k, exp := range c.entries {
+			if !now.Before(exp) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[jti] = expires
+	return true
+}
@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+	"gopkg.in/square/go-jose.v2"
+)
+
+var (
+	ErrUntrustedIssuer = errors.New("untrusted token issuer")
+	errInvalidAudience = errors.New("token audience is not trusted")
+)
+
+// BearerVerifier APIクライアントが送信したベアラートークン(JWT)を信頼する発行者の鍵で検証します。
+// 発行者毎のJWKSはキャッシュされ、未知のkidが現れた場合に再取得されます。
+type BearerVerifier struct {
+	ctx     context.Context
+	issuers map[string]*trustedIssuer
+}
+
+type trustedIssuer struct {
+	conf   config.TrustedIssuer
+	mu     sync.Mutex
+	keySet *remoteKeySet
+	// signingAlgs トークンの署名アルゴリズム(未設定の場合はRS256)
+	signingAlgs []string
+}
+
+// NewBearerVerifier BearerVerifierを生成します。
+// ctxは発行者のディスカバリ情報やJWKSの取得に使用されます。
+func NewBearerVerifier(ctx context.Context, issuers []config.TrustedIssuer) *BearerVerifier {
+	v := &BearerVerifier{
+		ctx:     ctx,
+		issuers: map[string]*trustedIssuer{},
+	}
+	for _, issuer := range issuers {
+		v.issuers[issuer.Issuer] = &trustedIssuer{conf: issuer}
+	}
+	return v
+}
+
+// Verify トークンの署名・発行者・audience・有効期限を検証します。
+func (v *BearerVerifier) Verify(ctx context.Context, rawToken string) (*oidc.IDToken, error) {
+	iss, err := unverifiedIssuer(rawToken)
+	if err != nil {
+		return nil, err
+	}
+	issuer, ok := v.issuers[iss]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUntrustedIssuer, iss)
+	}
+	keySet, algs, err := issuer.getKeySet(v.ctx)
+	if err != nil {
+		return nil, err
+	}
+	token, err := oidc.NewVerifier(iss, keySet, &oidc.Config{
+		SkipClientIDCheck:    true,
+		SupportedSigningAlgs: algs,
+	}).Verify(ctx, rawToken)
+	if err != nil {
+		return nil, err
+	}
+	if !containsAny(token.Audience, issuer.conf.Audiences) {
+		return nil, errInvalidAudience
+	}
+	return token, nil
+}
+
+// Trusted トークンが信頼する発行者のJWTかを返します。署名の検証は行いません。
+func (v *BearerVerifier) Trusted(rawToken string) bool {
+	iss, err := unverifiedIssuer(rawToken)
+	if err != nil {
+		return false
+	}
+	_, ok := v.issuers[iss]
+	return ok
+}
+
+// getKeySet 発行者のJWKSと署名アルゴリズムを返します。
+// 署名アルゴリズムはsigning_algsが未設定の場合、ディスカバリ情報のid_token_signing_alg_values_supportedを使用します。
+func (i *trustedIssuer) getKeySet(ctx context.Context) (*remoteKeySet, []string, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.keySet != nil {
+		return i.keySet, i.signingAlgs, nil
+	}
+	jwksURL := i.conf.JwksUri
+	algs := i.conf.SigningAlgs
+	if jwksURL == "" {
+		provider, err := oidc.NewProvider(ctx, i.conf.Issuer)
+		if err != nil {
+			return nil, nil, err
+		}
+		var discovery struct {
+			JWKSURL     string   `json:"jwks_uri"`
+			SigningAlgs []string `json:"id_token_signing_alg_values_supported"`
+		}
+		if err := provider.Claims(&discovery); err != nil {
+			return nil, nil, err
+		}
+		jwksURL = discovery.JWKSURL
+		if len(algs) == 0 {
+			algs = signingAlgs(discovery.SigningAlgs)
+		}
+	}
+	i.keySet = newRemoteKeySet(ctx, jwksURL)
+	i.signingAlgs = algs
+	return i.keySet, i.signingAlgs, nil
+}
+
+func unverifiedIssuer(rawToken string) (string, error) {
+	jws, err := jose.ParseSigned(rawToken)
+	if err != nil {
+		return "", fmt.Errorf("malformed jwt: %v", err)
+	}
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err := json.Unmarshal(jws.UnsafePayloadWithoutVerification(), &claims); err != nil {
+		return "", fmt.Errorf("malformed jwt: %v", err)
+	}
+	return claims.Issuer, nil
+}
+
+func containsAny(values, candidates []string) bool {
+	for _, v := range values {
+		for _, c := range candidates {
+			if v == c {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBearerVerifierSigningAlgs(t *testing.T) {
+	idp := newECDSAIdP(t, []string{"ES256"})
+	defer idp.Close()
+	rawToken := idp.sign(t, map[string]interface{}{
+		"iss": idp.URL,
+		"aud": "api",
+		"sub": "client",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	tests := []struct {
+		name   string
+		issuer config.TrustedIssuer
+		valid  bool
+	}{
+		{name: "discovery", issuer: config.TrustedIssuer{Issuer: idp.URL, Audiences: []string{"api"}}, valid: true},
+		{name: "signing_algs", issuer: config.TrustedIssuer{Issuer: idp.URL, Audiences: []string{"api"}, JwksUri: idp.URL + "/jwks", SigningAlgs: []string{"ES256"}}, valid: true},
+		{name: "default rs256", issuer: config.TrustedIssuer{Issuer: idp.URL, Audiences: []string{"api"}, JwksUri: idp.URL + "/jwks"}, valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewBearerVerifier(context.Background(), []config.TrustedIssuer{tt.issuer}).Verify(context.Background(), rawToken)
+			if tt.valid {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/logger"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/watch"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/watch/key"
+)
+
+// Cache バーチャルサーバー毎に保持するAuthenticatorです。
+// ディスカバリ情報はバックグラウンドで定期的に更新されます。
+type Cache struct {
+	mu          sync.RWMutex
+	discoveryMu sync.Mutex
+	// ctx IdPへのリクエストに使用します。Close後も処理中のリクエストが使用するためキャンセルしません
+	ctx context.Context
+	// done Closeで閉じられ、定期更新を停止します
+	done          chan struct{}
+	closeOnce     sync.Once
+	closed        bool
+	conf          config.Oidc
+	authenticator *Authenticator
+	// keyWatcher private_key_jwtの秘密鍵ファイルを監視し、更新時に再読込します。
+	keyWatcher *watch.Watch
+}
+
+// NewCache Cacheを生成し、ディスカバリ情報の定期更新を開始します。
+// ctxはIdPへのリクエストに使用されます。
+func NewCache(ctx context.Context, oidcConf config.Oidc) *Cache {
+	c := &Cache{
+		ctx:  ctx,
+		done: make(chan struct{}),
+		conf: oidcConf,
+	}
+	if oidcConf.TokenEndpointAuthMethod == config.PrivateKeyJwt {
+		if err := c.watchPrivateKey(); err != nil {
+			logger.FromContext(ctx).Error(fmt.Sprintf("private key error: %v", err))
+		}
+	}
+	go c.run(oidcConf.GetDiscoveryInterval())
+	return c
+}
+
+// Authenticator キャッシュしているAuthenticatorを返します。
+// まだディスカバリが完了していない場合はその場で取得します。
+func (c *Cache) Authenticator() (*Authenticator, error) {
+	c.mu.RLock()
+	authenticator := c.authenticator
+	c.mu.RUnlock()
+	if authenticator != nil {
+		return authenticator, nil
+	}
+	return c.discover(false)
+}
+
+// ErrCacheClosed Close後にディスカバリ情報を取得しようとした場合のエラーです。
+var ErrCacheClosed = errors.New("oidc: cache closed")
+
+func (c *Cache) discover(force bool) (*Authenticator, error) {
+	c.discoveryMu.Lock()
+	defer c.discoveryMu.Unlock()
+	c.mu.RLock()
+	prev, closed := c.authenticator, c.closed
+	c.mu.RUnlock()
+	if closed {
+		// 設定の再読込で破棄された後は、処理中のリクエストに最後に取得した値を返す
+		if prev != nil {
+			return prev, nil
+		}
+		return nil, ErrCacheClosed
+	}
+	if prev != nil && !force {
+		return prev, nil
+	}
+	authenticator, err := newAuthenticator(c.ctx, c.conf, prev, c.privateKey)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.authenticator = authenticator
+	c.mu.Unlock()
+	return authenticator, nil
+}
+
+func (c *Cache) run(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-c.ctx.Done():
+			return
+		case <-t.C:
+			if _, err := c.discover(true); err != nil {
+				logger.FromContext(c.ctx).Error(fmt.Sprintf("oidc discovery error: %v", err))
+			}
+		}
+	}
+}
+
+func (c *Cache) watchPrivateKey() error {
+	w, err := watch.New(logger.FromContext(c.ctx))
+	if err != nil {
+		return err
+	}
+	kw, err := key.New(c.conf.PrivateKey)
+	if err != nil {
+		return err
+	}
+	w.Watching = kw
+	if err := w.Watch(); err != nil {
+		return err
+	}
+	c.keyWatcher = w
+	return nil
+}
+
+// privateKey 監視している秘密鍵を返します。読み込めていない場合はnilを返します。
+func (c *Cache) privateKey() crypto.Signer {
+	if c.keyWatcher == nil {
+		return nil
+	}
+	return c.keyWatcher.Watching.(*key.Watch).PrivateKey()
+}
+
+// Close ディスカバリ情報の定期更新と秘密鍵の監視を停止します。
+// 設定の再読込後も旧設定で処理中のリクエストが使用できるよう、取得済みのAuthenticatorは保持します。
+func (c *Cache) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+		close(c.done)
+		if c.keyWatcher != nil {
+			c.keyWatcher.Stop()
+		}
+	})
+	return nil
+}
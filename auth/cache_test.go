@@ -0,0 +1,49 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheClose(t *testing.T) {
+	var discovered int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&discovered, 1)
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/authorize",
+			"token_endpoint":         srv.URL + "/token",
+			"jwks_uri":               srv.URL + "/jwks",
+		})
+	}))
+	defer srv.Close()
+	conf := config.Oidc{Provider: srv.URL, ClientId: "client"}
+
+	cache := NewCache(context.Background(), conf)
+	authenticator, err := cache.Authenticator()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, cache.Close())
+	// 設定の再読込で破棄された後も処理中のリクエストは取得済みの値を使用し、再取得しない
+	after, err := cache.Authenticator()
+	assert.NoError(t, err)
+	assert.Same(t, authenticator, after)
+	_, err = cache.discover(true)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&discovered))
+	assert.NoError(t, cache.Close())
+
+	closed := NewCache(context.Background(), conf)
+	closed.Close()
+	_, err = closed.Authenticator()
+	assert.Equal(t, ErrCacheClosed, err)
+}
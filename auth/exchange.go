@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// GrantTypeTokenExchange RFC 8693のトークン交換のgrant_typeです。
+	GrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	// TokenTypeAccessToken RFC 8693のアクセストークンを表すトークンタイプです。
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// exchangedTokenPrefix 交換したトークンを保存するセッションのキーの接頭辞です。
+const exchangedTokenPrefix = "exchanged_token_"
+
+// ExchangeToken subjectTokenをトークンエンドポイントで交換します(RFC 8693)。
+// IdPがエラーを返却した場合は*oauth2.RetrieveErrorを返します。
+func (a *Authenticator) ExchangeToken(ctx context.Context, subjectToken string, conf config.TokenExchange) (*oauth2.Token, error) {
+	form := url.Values{
+		"grant_type":         {GrantTypeTokenExchange},
+		"subject_token":      {subjectToken},
+		"subject_token_type": {TokenTypeAccessToken},
+	}
+	if conf.Audience != "" {
+		form.Set("audience", conf.Audience)
+	}
+	if conf.Resource != "" {
+		form.Set("resource", conf.Resource)
+	}
+	if len(conf.Scopes) > 0 {
+		form.Set("scope", strings.Join(conf.Scopes, " "))
+	}
+	if conf.RequestedTokenType != "" {
+		form.Set("requested_token_type", conf.RequestedTokenType)
+	}
+	return a.tokenRequest(ctx, form)
+}
+
+// ExchangedToken セッションにキャッシュした交換済みのトークンを返します。
+// 交換元のトークンが更新された場合や、有効期限までskew未満の場合はfalseを返します。
+func ExchangedToken(session *sessions.Session, conf config.TokenExchange, subjectToken string, skew time.Duration) (string, bool) {
+	cached, ok := session.Values[exchangedTokenKey(conf)].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	if subject, _ := cached["subject"].(string); subject != tokenHash(subjectToken) {
+		return "", false
+	}
+	token, _ := cached["token"].(string)
+	if token == "" {
+		return "", false
+	}
+	if expiry := cachedExpiry(cached); !expiry.IsZero() && time.Now().Add(skew).After(expiry) {
+		return "", false
+	}
+	return token, true
+}
+
+// ExchangedTokenExpiry セッションにキャッシュした交換済みのトークンの有効期限を返します。
+func ExchangedTokenExpiry(session *sessions.Session, conf config.TokenExchange) time.Time {
+	cached, _ := session.Values[exchangedTokenKey(conf)].(map[string]interface{})
+	return cachedExpiry(cached)
+}
+
+func cachedExpiry(cached map[string]interface{}) time.Time {
+	switch v := cached["expiry"].(type) {
+	case int64:
+		return time.Unix(v, 0)
+	case float64:
+		return time.Unix(int64(v), 0)
+	}
+	return time.Time{}
+}
+
+// SetExchangedToken 交換したトークンを交換元のトークンと紐付けてセッションへキャッシュします。
+func SetExchangedToken(session *sessions.Session, conf config.TokenExchange, subjectToken string, token *oauth2.Token) {
+	cached := map[string]interface{}{
+		"subject": tokenHash(subjectToken),
+		"token":   token.AccessToken,
+	}
+	if !token.Expiry.IsZero() {
+		cached["expiry"] = token.Expiry.Unix()
+	}
+	session.Values[exchangedTokenKey(conf)] = cached
+}
+
+// exchangedTokenKey 交換先(audience、resource、scope)毎のセッションのキーを返します。
+func exchangedTokenKey(conf config.TokenExchange) string {
+	return exchangedTokenPrefix + tokenHash(strings.Join([]string{
+		conf.Audience,
+		conf.Resource,
+		strings.Join(conf.Scopes, " "),
+		conf.RequestedTokenType,
+	}, "\n"))
+}
+
+func tokenHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errNoIntrospectionEndpoint = errors.New("introspection: provider has no introspection_endpoint")
+
+// Introspection トークンイントロスペクション(RFC 7662)の結果です。
+type Introspection struct {
+	// Active トークンが有効か
+	Active bool
+	// Claims レスポンスに含まれるsub, scope等のクレーム
+	Claims Claims
+	// Expiry トークンの有効期限(expが返却されない場合はゼロ値)
+	Expiry time.Time
+}
+
+// Scopes トークンに付与されたスコープを返します。
+func (i *Introspection) Scopes() []string {
+	scope, _ := i.Claims["scope"].(string)
+	return strings.Fields(scope)
+}
+
+// Audiences トークンの対象となるaudとclient_idを返します。
+func (i *Introspection) Audiences() []string {
+	var audiences []string
+	switch aud := i.Claims["aud"].(type) {
+	case string:
+		audiences = append(audiences, aud)
+	case []interface{}:
+		for _, v := range aud {
+			if s, ok := v.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+	if clientID, ok := i.Claims["client_id"].(string); ok && clientID != "" {
+		audiences = append(audiences, clientID)
+	}
+	return audiences
+}
+
+// HasAudience トークンの対象に指定したaudまたはclient_idのいずれかが含まれるかを返します。
+func (i *Introspection) HasAudience(audiences []string) bool {
+	return containsAny(i.Audiences(), audiences)
+}
+
+// Introspect アクセストークンの有効性をIdPのイントロスペクションエンドポイントで確認します。
+// 結果はintrospection_cache_ttlの間、トークンの有効期限を超えない範囲でキャッシュされます。
+func (a *Authenticator) Introspect(ctx context.Context, token string) (*Introspection, error) {
+	if a.introspectionURL == "" {
+		return nil, errNoIntrospectionEndpoint
+	}
+	key := tokenHash(token)
+	if result, ok := a.introspection.get(key); ok {
+		return result, nil
+	}
+	res, body, err := a.clientRequest(ctx, a.introspectionURL, url.Values{
+		"token":           {token},
+		"token_type_hint": {"access_token"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusBadRequest {
+		// 形式が不正なトークンを拒否するIdPがあるため、無効なトークンとして扱う
+		return &Introspection{}, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection: %s: %s", res.Status, body)
+	}
+	if contentType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); contentType != "application/json" {
+		return nil, fmt.Errorf("introspection: unexpected content type %q", res.Header.Get("Content-Type"))
+	}
+	var claims Claims
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, err
+	}
+	result := &Introspection{
+		Claims: claims,
+	}
+	result.Active, _ = claims["active"].(bool)
+	if exp, ok := claims["exp"].(float64); ok {
+		result.Expiry = time.Unix(int64(exp), 0)
+	}
+	if !result.Expiry.IsZero() && !result.Expiry.After(time.Now()) {
+		result.Active = false
+	}
+	a.introspection.set(key, result)
+	return result, nil
+}
+
+// maxIntrospectionEntries キャッシュするイントロスペクション結果の上限です。
+const maxIntrospectionEntries = 10000
+
+type introspectionEntry struct {
+	result  *Introspection
+	expires time.Time
+}
+
+// introspectionCache トークンのハッシュ毎にイントロスペクションの結果を保持します。
+type introspectionCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]introspectionEntry
+}
+
+func newIntrospectionCache(ttl time.Duration) *introspectionCache {
+	return &introspectionCache{
+		ttl:     ttl,
+		entries: map[string]introspectionEntry{},
+	}
+}
+
+func (c *introspectionCache) get(key string) (*Introspection, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !time.Now().Before(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.result, true
+}
+
+func (c *introspectionCache) set(key string, result *Introspection) {
+	now := time.Now()
+	expires := now.Add(c.ttl)
+	if result.Active && !result.Expiry.IsZero() && result.Expiry.Before(expires) {
+		expires = result.Expiry
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxIntrospectionEntries {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// 期限切れがない場合は任意のエントリを削除して上限を保つ
+		for k := range c.entries {
+			if len(c.entries) < maxIntrospectionEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = introspectionEntry{
+		result:  result,
+		expires: expires,
+	}
+}
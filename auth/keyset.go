@@ -0,0 +1,138 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// minKeysRefreshInterval 未知のkidによるJWKSの再取得を行う最短間隔です。
+const minKeysRefreshInterval = 10 * time.Second
+
+var errVerifySignature = errors.New("failed to verify token signature")
+
+// remoteKeySet JWKSをキャッシュし、未知のkidが現れた場合に再取得するoidc.KeySetです。
+type remoteKeySet struct {
+	jwksURL string
+	ctx     context.Context
+
+	mu        sync.RWMutex
+	keys      []jose.JSONWebKey
+	fetchedAt time.Time
+
+	fetchMu sync.Mutex
+}
+
+func newRemoteKeySet(ctx context.Context, jwksURL string) *remoteKeySet {
+	return &remoteKeySet{
+		jwksURL: jwksURL,
+		ctx:     ctx,
+	}
+}
+
+func (r *remoteKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %v", err)
+	}
+	keyID := ""
+	for _, sig := range jws.Signatures {
+		keyID = sig.Header.KeyID
+		break
+	}
+	keys, fetchedAt := r.cachedKeys()
+	if payload, ok := verifyWithKeys(jws, keyID, keys); ok {
+		return payload, nil
+	}
+	if keyID != "" && hasKeyID(keys, keyID) {
+		// 既知の鍵で検証に失敗した場合は再取得しない
+		return nil, errVerifySignature
+	}
+	keys, err = r.refresh(ctx, fetchedAt)
+	if err != nil {
+		return nil, err
+	}
+	if payload, ok := verifyWithKeys(jws, keyID, keys); ok {
+		return payload, nil
+	}
+	return nil, errVerifySignature
+}
+
+func (r *remoteKeySet) cachedKeys() ([]jose.JSONWebKey, time.Time) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.keys, r.fetchedAt
+}
+
+// refresh JWKSを再取得します。並行して呼ばれた場合は先に取得した結果を共有します。
+func (r *remoteKeySet) refresh(ctx context.Context, seen time.Time) ([]jose.JSONWebKey, error) {
+	r.fetchMu.Lock()
+	defer r.fetchMu.Unlock()
+	keys, fetchedAt := r.cachedKeys()
+	if fetchedAt.After(seen) || (!fetchedAt.IsZero() && time.Since(fetchedAt) < minKeysRefreshInterval) {
+		return keys, nil
+	}
+	keys, err := r.fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.keys = keys
+	r.fetchedAt = time.Now()
+	r.mu.Unlock()
+	return keys, nil
+}
+
+func (r *remoteKeySet) fetch(ctx context.Context) ([]jose.JSONWebKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := httpClient(r.ctx).Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching keys: %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching keys: %s", res.Status)
+	}
+	var keySet jose.JSONWebKeySet
+	if err := json.NewDecoder(res.Body).Decode(&keySet); err != nil {
+		return nil, fmt.Errorf("fetching keys: %v", err)
+	}
+	return keySet.Keys, nil
+}
+
+func verifyWithKeys(jws *jose.JSONWebSignature, keyID string, keys []jose.JSONWebKey) ([]byte, bool) {
+	for _, key := range keys {
+		if keyID == "" || key.KeyID == keyID {
+			if payload, err := jws.Verify(&key); err == nil {
+				return payload, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func hasKeyID(keys []jose.JSONWebKey, keyID string) bool {
+	for _, key := range keys {
+		if key.KeyID == keyID {
+			return true
+		}
+	}
+	return false
+}
+
+func httpClient(ctx context.Context) *http.Client {
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		return c
+	}
+	return http.DefaultClient
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2/jws"
+	"gopkg.in/square/go-jose.v2"
+)
+
+func TestRemoteKeySetRefreshOnUnknownKeyID(t *testing.T) {
+	oldKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	newKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var rotated atomic.Value
+	rotated.Store(false)
+	var fetched int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+		keys := []jose.JSONWebKey{{Key: oldKey.Public(), KeyID: "old"}}
+		if rotated.Load().(bool) {
+			keys = append(keys, jose.JSONWebKey{Key: newKey.Public(), KeyID: "new"})
+		}
+		json.NewEncoder(w).Encode(&jose.JSONWebKeySet{Keys: keys})
+	}))
+	defer srv.Close()
+
+	sign := func(key *rsa.PrivateKey, kid string) string {
+		token, err := jws.Encode(&jws.Header{Algorithm: "RS256", KeyID: kid}, &jws.ClaimSet{Iss: "test"}, key)
+		assert.NoError(t, err)
+		return token
+	}
+	ctx := context.Background()
+	keySet := newRemoteKeySet(ctx, srv.URL)
+
+	_, err := keySet.VerifySignature(ctx, sign(oldKey, "old"))
+	assert.NoError(t, err)
+	_, err = keySet.VerifySignature(ctx, sign(oldKey, "old"))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetched))
+
+	rotated.Store(true)
+	keySet.fetchedAt = keySet.fetchedAt.Add(-minKeysRefreshInterval)
+	_, err = keySet.VerifySignature(ctx, sign(newKey, "new"))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetched))
+
+	// 既知のkidで署名が一致しない場合は再取得しない
+	_, err = keySet.VerifySignature(ctx, sign(newKey, "old"))
+	assert.Error(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetched))
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"net/url"
+)
+
+// EndSessionEndpoint ディスカバリ情報のend_session_endpointを返します。
+func (a *Authenticator) EndSessionEndpoint() string {
+	if a.IsOAuth2() {
+		return ""
+	}
+	var claims struct {
+		EndSessionEndpoint string `json:"end_session_endpoint"`
+	}
+	if err := a.Provider.Claims(&claims); err != nil {
+		return ""
+	}
+	return claims.EndSessionEndpoint
+}
+
+// EndSessionURL RP-Initiated Logoutのリクエスト先URLを生成します。
+// プロバイダがend_session_endpointに対応していない場合は空文字を返します。
+func (a *Authenticator) EndSessionURL(idTokenHint, postLogoutRedirectURI, state string) (string, error) {
+	endpoint := a.EndSessionEndpoint()
+	if endpoint == "" {
+		return "", nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if idTokenHint != "" {
+		q.Set("id_token_hint", idTokenHint)
+	}
+	q.Set("client_id", a.Config.ClientID)
+	if postLogoutRedirectURI != "" {
+		q.Set("post_logout_redirect_uri", postLogoutRedirectURI)
+		if state != "" {
+			q.Set("state", state)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+
+	"golang.org/x/oauth2"
+)
+
+const codeChallengeMethodS256 = "S256"
+
+// NewCodeVerifier RFC 7636 のcode_verifierを生成します。
+func NewCodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// CodeChallengeS256 code_verifierからS256のcode_challengeを算出します。
+func CodeChallengeS256(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// CodeChallengeOptions 認可リクエストへ付与するcode_challengeのパラメータです。
+func CodeChallengeOptions(verifier string) []oauth2.AuthCodeOption {
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("code_challenge", CodeChallengeS256(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", codeChallengeMethodS256),
+	}
+}
+
+// CodeVerifierOption トークンリクエストへ付与するcode_verifierのパラメータです。
+func CodeVerifierOption(verifier string) oauth2.AuthCodeOption {
+	return oauth2.SetAuthURLParam("code_verifier", verifier)
+}
+
+// SupportsPKCE プロバイダのディスカバリ情報にS256が含まれているかを返します。
+// ディスカバリ情報を持たないOAuth2のプロバイダは対応を確認できないため、対応していないものとします。
+func (a *Authenticator) SupportsPKCE() bool {
+	if a.IsOAuth2() {
+		return false
+	}
+	var claims struct {
+		CodeChallengeMethodsSupported []string `json:"code_challenge_methods_supported"`
+	}
+	if err := a.Provider.Claims(&claims); err != nil {
+		return false
+	}
+	for _, method := range claims.CodeChallengeMethodsSupported {
+		if method == codeChallengeMethodS256 {
+			return true
+		}
+	}
+	return false
+}
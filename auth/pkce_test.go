@@ -0,0 +1,20 @@
+package auth_test
+
+import (
+	"testing"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodeChallengeS256(t *testing.T) {
+	// RFC 7636 Appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	assert.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", auth.CodeChallengeS256(verifier))
+}
+
+func TestNewCodeVerifier(t *testing.T) {
+	verifier, err := auth.NewCodeVerifier()
+	assert.NoError(t, err)
+	assert.Len(t, verifier, 43)
+}
@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrInsufficientAcr IDトークンのacrが要求を満たさない場合のエラーです。
+	ErrInsufficientAcr = errors.New("insufficient authentication context class")
+	// ErrAuthTooOld ログインからの経過時間が上限を超えている場合のエラーです。
+	ErrAuthTooOld = errors.New("authentication is too old")
+)
+
+// CheckAuthentication トークンのacrとauth_timeが要求を満たすかを検証します。
+// acrValuesが空の場合はacrを、maxAgeが0の場合はauth_timeを検証しません。
+func CheckAuthentication(claims Claims, acrValues []string, maxAge time.Duration) error {
+	if len(acrValues) > 0 {
+		acr, _ := claims["acr"].(string)
+		if !containsAny([]string{acr}, acrValues) {
+			return fmt.Errorf("%w: %q", ErrInsufficientAcr, acr)
+		}
+	}
+	if maxAge > 0 {
+		// auth_timeが無い場合はログイン時刻が不明のため満たさないものとする
+		authTime, ok := claims["auth_time"].(float64)
+		if !ok || time.Since(time.Unix(int64(authTime), 0)) > maxAge {
+			return ErrAuthTooOld
+		}
+	}
+	return nil
+}
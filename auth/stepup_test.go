@@ -0,0 +1,39 @@
+package auth_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/auth"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckAuthentication(t *testing.T) {
+	now := float64(time.Now().Unix())
+	tests := []struct {
+		name      string
+		claims    auth.Claims
+		acrValues []string
+		maxAge    time.Duration
+		err       error
+	}{
+		{name: "no requirement", claims: auth.Claims{}},
+		{name: "acr", claims: auth.Claims{"acr": "mfa"}, acrValues: []string{"phr", "mfa"}},
+		{name: "insufficient acr", claims: auth.Claims{"acr": "pwd"}, acrValues: []string{"mfa"}, err: auth.ErrInsufficientAcr},
+		{name: "no acr", claims: auth.Claims{}, acrValues: []string{"mfa"}, err: auth.ErrInsufficientAcr},
+		{name: "recent login", claims: auth.Claims{"auth_time": now - 60}, maxAge: 5 * time.Minute},
+		{name: "old login", claims: auth.Claims{"auth_time": now - 600}, maxAge: 5 * time.Minute, err: auth.ErrAuthTooOld},
+		{name: "no auth_time", claims: auth.Claims{}, maxAge: 5 * time.Minute, err: auth.ErrAuthTooOld},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := auth.CheckAuthentication(tt.claims, tt.acrValues, tt.maxAge)
+			if tt.err == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, tt.err))
+			}
+		})
+	}
+}
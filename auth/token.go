@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// clientRequest クライアント認証を付与してIdPのエンドポイントへフォームをPOSTします。
+func (a *Authenticator) clientRequest(ctx context.Context, endpoint string, form url.Values) (*http.Response, []byte, error) {
+	if a.assertion != nil {
+		params, err := a.assertion.params(a.Config.Endpoint.TokenURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		for key, values := range params {
+			form[key] = values
+		}
+	} else if a.Config.Endpoint.AuthStyle == oauth2.AuthStyleInParams {
+		form.Set("client_id", a.Config.ClientID)
+		if a.Config.ClientSecret != "" {
+			form.Set("client_secret", a.Config.ClientSecret)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if a.assertion == nil && a.Config.Endpoint.AuthStyle != oauth2.AuthStyleInParams {
+		req.SetBasicAuth(url.QueryEscape(a.Config.ClientID), url.QueryEscape(a.Config.ClientSecret))
+	}
+	res, err := httpClient(ctx).Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, body, nil
+}
+
+// tokenRequest クライアント認証を付与してトークンエンドポイントへリクエストします。
+func (a *Authenticator) tokenRequest(ctx context.Context, form url.Values) (*oauth2.Token, error) {
+	res, body, err := a.clientRequest(ctx, a.Config.Endpoint.TokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, &oauth2.RetrieveError{Response: res, Body: body}
+	}
+	if contentType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type")); contentType != "application/json" {
+		return nil, fmt.Errorf("oauth2: unexpected token response content type %q", res.Header.Get("Content-Type"))
+	}
+	var tokenRes struct {
+		AccessToken     string      `json:"access_token"`
+		IssuedTokenType string      `json:"issued_token_type"`
+		TokenType       string      `json:"token_type"`
+		RefreshToken    string      `json:"refresh_token"`
+		ExpiresIn       json.Number `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &tokenRes); err != nil {
+		return nil, err
+	}
+	if tokenRes.AccessToken == "" {
+		return nil, fmt.Errorf("oauth2: server response missing access_token")
+	}
+	token := &oauth2.Token{
+		AccessToken:  tokenRes.AccessToken,
+		TokenType:    tokenRes.TokenType,
+		RefreshToken: tokenRes.RefreshToken,
+	}
+	if expiresIn, _ := tokenRes.ExpiresIn.Int64(); expiresIn > 0 {
+		token.Expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	}
+	var raw map[string]interface{}
+	json.Unmarshal(body, &raw)
+	return token.WithExtra(raw), nil
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+var errNoSubject = errors.New("userinfo: no subject claim")
+
+// ErrUserInfoUnauthorized ユーザー情報エンドポイントがアクセストークンを拒否したことを表します。
+var ErrUserInfoUnauthorized = errors.New("userinfo: access token was rejected")
+
+// IsOAuth2 IDトークンを発行しないOAuth2のプロバイダかを返します。
+func (a *Authenticator) IsOAuth2() bool {
+	return a.Provider == nil
+}
+
+// HasUserInfo ユーザー情報エンドポイントを使用できるかを返します。
+func (a *Authenticator) HasUserInfo() bool {
+	return a.userInfoURL != ""
+}
+
+// UserInfo ユーザー情報エンドポイントからクレームを取得します。
+// OAuth2のプロバイダでsubが含まれない場合はsubject_claimの値をsubとして設定します。
+func (a *Authenticator) UserInfo(ctx context.Context, accessToken string) (Claims, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.userInfoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	res, err := httpClient(ctx).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		return nil, ErrUserInfoUnauthorized
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("userinfo: %s: %s", res.Status, body)
+	}
+	var claims Claims
+	if err := json.Unmarshal(body, &claims); err != nil {
+		return nil, err
+	}
+	switch sub := claims[a.subjectClaim].(type) {
+	case string:
+		claims["sub"] = sub
+	case float64:
+		// GitHubのidなど数値のIDは文字列へ変換する
+		claims["sub"] = strconv.FormatFloat(sub, 'f', -1, 64)
+	default:
+		return nil, errNoSubject
+	}
+	return claims, nil
+}
+
+// RevalidateUserInfo リフレッシュトークンを持たないOAuth2のセッションのアクセストークンをユーザー情報エンドポイントで再検証します。
+// 有効な場合はキャッシュしたユーザー情報を更新し、default_token_lifetimeだけ有効期限を延長します。
+// 取り消されたトークンや別のユーザーのトークンの場合はErrUserInfoUnauthorizedを返します。
+func (a *Authenticator) RevalidateUserInfo(ctx context.Context, session *sessions.Session) error {
+	accessToken, _ := session.Values["access_token"].(string)
+	cached, ok := UserInfoClaims(session)
+	if accessToken == "" || !ok {
+		return ErrUserInfoUnauthorized
+	}
+	claims, err := a.UserInfo(ctx, accessToken)
+	if err != nil {
+		return err
+	}
+	if claims["sub"] != cached["sub"] {
+		return ErrUserInfoUnauthorized
+	}
+	expiry := time.Now().Add(a.tokenLifetime)
+	SetUserInfo(session, claims)
+	session.Values["expiry"] = expiry.Unix()
+	SetIDTokenExpiry(session, expiry)
+	return nil
+}
+
+// SetUserInfo ユーザー情報のクレームをセッションへキャッシュします。
+func SetUserInfo(session *sessions.Session, claims Claims) {
+	session.Values["userinfo"] = map[string]interface{}(claims)
+}
+
+// UserInfoClaims セッションにキャッシュしたユーザー情報のクレームを返します。
+func UserInfoClaims(session *sessions.Session) (Claims, bool) {
+	claims, ok := session.Values["userinfo"].(map[string]interface{})
+	return Claims(claims), ok
+}
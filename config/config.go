@@ -8,10 +8,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	hplugin "github.com/hashicorp/go-plugin"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/app"
@@ -28,13 +30,15 @@ import (
 
 // Config
 type Config struct {
-	Logging           Logging             `yaml:"logging" toml:"logging" json:"logging"`
-	Servers           []*Servers          `yaml:"servers" toml:"servers" json:"servers"`
-	Port              int                 `yaml:"port" toml:"port" json:"port"`
-	SslCertificate    string              `yaml:"ssl_certificate" toml:"ssl_certificate" json:"ssl_certificate"`
-	SslCertificateKey string              `yaml:"ssl_certificate_key" toml:"ssl_certificate_key" json:"ssl_certificate_key"`
-	port              string              `yaml:"-" toml:"-" json:"-"`
-	mapSrvConfig      map[string]*Servers `yaml:"-" toml:"-" json:"-"`
+	Logging           Logging    `yaml:"logging" toml:"logging" json:"logging"`
+	Servers           []*Servers `yaml:"servers" toml:"servers" json:"servers"`
+	Port              int        `yaml:"port" toml:"port" json:"port"`
+	SslCertificate    string     `yaml:"ssl_certificate" toml:"ssl_certificate" json:"ssl_certificate"`
+	SslCertificateKey string     `yaml:"ssl_certificate_key" toml:"ssl_certificate_key" json:"ssl_certificate_key"`
+	// ExtAuthz Envoyの外部認可サービス(gRPC)の設定
+	ExtAuthz     ExtAuthz            `yaml:"ext_authz" toml:"ext_authz" json:"ext_authz"`
+	port         string              `yaml:"-" toml:"-" json:"-"`
+	mapSrvConfig map[string]*Servers `yaml:"-" toml:"-" json:"-"`
 }
 
 func (c *Config) GetPort() string {
@@ -48,6 +52,20 @@ func (c *Config) GetPort() string {
 	return c.port
 }
 
+// ExtAuthz
+type ExtAuthz struct {
+	// Port 外部認可サービスを待ち受けるポート番号(未設定の場合は起動しない)
+	Port int `yaml:"port" toml:"port" json:"port"`
+}
+
+func (e *ExtAuthz) IsEnabled() bool {
+	return e.Port > 0
+}
+
+func (e *ExtAuthz) GetAddr() string {
+	return ":" + strconv.Itoa(e.Port)
+}
+
 func (c *Config) GetServerConfig(serverName string) *Servers {
 	return c.mapSrvConfig[serverName]
 }
@@ -95,7 +113,108 @@ type Servers struct {
 	Login      string      `yaml:"login" toml:"login" json:"login"`
 	Callback   string      `yaml:"callback" toml:"callback" json:"callback"`
 	Logout     string      `yaml:"logout" toml:"logout" json:"logout"`
-	Redirect   bool        `yaml:"redirect" toml:"redirect" json:"redirect"`
+	PostLogout string      `yaml:"post_logout" toml:"post_logout" json:"post_logout"`
+	// BackchannelLogout IdPからログアウト通知を受け取るパス
+	BackchannelLogout string `yaml:"backchannel_logout" toml:"backchannel_logout" json:"backchannel_logout"`
+	// FrontchannelLogout IdPがiframeで読み込むログアウトのパス
+	FrontchannelLogout string `yaml:"frontchannel_logout" toml:"frontchannel_logout" json:"frontchannel_logout"`
+	// AuthCheck nginx auth_requestなどのフォワード認証で使用するセッション確認のパス
+	AuthCheck string `yaml:"auth_check" toml:"auth_check" json:"auth_check"`
+	// AuthCheckHeaders セッション確認のレスポンスへ付与するヘッダー名とクレームの対応
+	AuthCheckHeaders map[string]string `yaml:"auth_check_headers" toml:"auth_check_headers" json:"auth_check_headers"`
+	// AllowedRedirectDomains ログイン後の戻り先(rd)として許可するドメイン(.から始まる場合はサブドメインを含む)
+	AllowedRedirectDomains []string `yaml:"allowed_redirect_domains" toml:"allowed_redirect_domains" json:"allowed_redirect_domains"`
+	Redirect               bool     `yaml:"redirect" toml:"redirect" json:"redirect"`
+	// Unauthenticated 未ログインのリクエストへの応答(redirect, unauthorized, auto)。未設定の場合はredirectに従います
+	Unauthenticated string `yaml:"unauthenticated" toml:"unauthenticated" json:"unauthenticated"`
+	// Providers oidcに加えて選択できるIdP
+	Providers []Provider `yaml:"providers" toml:"providers" json:"providers"`
+	// ProviderTemplate IdPの選択画面のテンプレート(html/template)のファイル
+	ProviderTemplate string `yaml:"provider_template" toml:"provider_template" json:"provider_template"`
+	// Bff シングルページアプリケーション向けのエンドポイントの設定
+	Bff Bff `yaml:"bff" toml:"bff" json:"bff"`
+}
+
+// Bff
+// SPAがトークンを扱わずにログイン状態を取得するためのエンドポイント(Backend for Frontend)です。
+type Bff struct {
+	// UserInfo IDトークンのクレームとユーザー情報をJSONで返すパス
+	UserInfo string `yaml:"userinfo" toml:"userinfo" json:"userinfo"`
+	// Session セッションの有効期限を返すパス。POSTの場合はトークンを更新します
+	Session string `yaml:"session" toml:"session" json:"session"`
+	// Token token_exchangeで交換したアクセストークンを返すパス
+	Token         string        `yaml:"token" toml:"token" json:"token"`
+	TokenExchange TokenExchange `yaml:"token_exchange" toml:"token_exchange" json:"token_exchange"`
+	// AllowedOrigins 同一オリジンに加えてsessionの更新とtokenへのリクエストを許可するオリジン
+	AllowedOrigins []string `yaml:"allowed_origins" toml:"allowed_origins" json:"allowed_origins"`
+}
+
+const (
+	// UnauthenticatedRedirect ログインURLへリダイレクトします
+	UnauthenticatedRedirect = "redirect"
+	// UnauthenticatedUnauthorized 401を返します
+	UnauthenticatedUnauthorized = "unauthorized"
+	// UnauthenticatedAuto ブラウザの画面遷移はリダイレクトし、XHR/fetchなどには401を返します
+	UnauthenticatedAuto = "auto"
+)
+
+func validUnauthenticated(value string) bool {
+	switch value {
+	case "", UnauthenticatedRedirect, UnauthenticatedUnauthorized, UnauthenticatedAuto:
+		return true
+	}
+	return false
+}
+
+// GetUnauthenticated ロケーションでの未ログインのリクエストへの応答を返します。
+func (s *Servers) GetUnauthenticated(location Locations) string {
+	if location.Unauthenticated != "" {
+		return location.Unauthenticated
+	}
+	if s.Unauthenticated != "" {
+		return s.Unauthenticated
+	}
+	if s.Redirect {
+		return UnauthenticatedRedirect
+	}
+	return UnauthenticatedUnauthorized
+}
+
+// DefaultProviderName oidcに設定されたIdPの名前です。
+const DefaultProviderName = "default"
+
+// Provider
+type Provider struct {
+	Name        string `yaml:"name" toml:"name" json:"name"`
+	DisplayName string `yaml:"display_name" toml:"display_name" json:"display_name"`
+	// Domains login_hintのメールアドレスのドメインがいずれかに一致する場合にこのIdPを使用する
+	Domains []string `yaml:"domains" toml:"domains" json:"domains"`
+	Oidc    Oidc     `yaml:"oidc" toml:"oidc" json:"oidc"`
+}
+
+// GetDisplayName 選択画面に表示する名前を返します。
+func (p *Provider) GetDisplayName() string {
+	if p.DisplayName != "" {
+		return p.DisplayName
+	}
+	for _, endpoint := range []string{p.Oidc.Provider, p.Oidc.AuthorizeUrl} {
+		if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+			return u.Host
+		}
+	}
+	return p.Name
+}
+
+// GetProviders oidcと追加のIdPを返します。oidcはdefaultとして先頭に含まれます。
+func (s *Servers) GetProviders() []Provider {
+	var providers []Provider
+	if s.Oidc.Provider != "" || s.Oidc.IsOAuth2() || len(s.Providers) == 0 {
+		providers = append(providers, Provider{
+			Name: DefaultProviderName,
+			Oidc: s.Oidc,
+		})
+	}
+	return append(providers, s.Providers...)
 }
 
 func (s *Servers) newSessionClient(client *hplugin.Client) session.Session {
@@ -153,10 +272,72 @@ func (s *Servers) Is() error {
 	if !s.Session.IsCodecs() {
 		return errors.New(msg("no codecs provided"))
 	}
+	if !validUnauthenticated(s.Unauthenticated) {
+		return errors.New(msg(fmt.Sprintf("%s: invalid unauthenticated", s.Unauthenticated)))
+	}
+	names := map[string]bool{}
+	for _, provider := range s.GetProviders() {
+		if provider.Name == "" {
+			return errors.New(msg("no provider name provided"))
+		}
+		if names[provider.Name] {
+			return errors.New(msg(fmt.Sprintf("%s: duplicate provider name", provider.Name)))
+		}
+		names[provider.Name] = true
+		if err := provider.Oidc.validateClientAuth(); err != nil {
+			return errors.New(msg(fmt.Sprintf("%s: %v", provider.Name, err)))
+		}
+		if err := provider.Oidc.validateType(); err != nil {
+			return errors.New(msg(fmt.Sprintf("%s: %v", provider.Name, err)))
+		}
+		if err := provider.Oidc.validatePkce(); err != nil {
+			return errors.New(msg(fmt.Sprintf("%s: %v", provider.Name, err)))
+		}
+	}
+	if s.Bff.Token != "" && !s.Bff.TokenExchange.IsEnabled() {
+		return errors.New(msg("bff token requires token_exchange audience or resource"))
+	}
+	for _, location := range s.Locations {
+		if !validUnauthenticated(location.Unauthenticated) {
+			return errors.New(msg(fmt.Sprintf("%s: invalid unauthenticated", location.Unauthenticated)))
+		}
+		if impersonation := location.Impersonation; impersonation.Enabled && (impersonation.ClientCert == "") != (impersonation.ClientKey == "") {
+			return errors.New(msg("impersonation requires both client_cert and client_key"))
+		}
+		if location.ClientCredentials.IsEnabled() && (location.TokenExchange.IsEnabled() || location.Impersonation.Enabled) {
+			return errors.New(msg("client_credentials cannot be combined with token_exchange or impersonation"))
+		}
+		if provider := location.ClientCredentials.Provider; provider != "" && !names[provider] {
+			return errors.New(msg(fmt.Sprintf("%s: unknown client_credentials provider", provider)))
+		}
+		for _, issuer := range location.Bearer.Issuers {
+			if issuer.Issuer == "" {
+				return errors.New(msg("no bearer issuer provided"))
+			}
+			if len(issuer.Audiences) == 0 {
+				return errors.New(msg(fmt.Sprintf("%s: no bearer audiences provided", issuer.Issuer)))
+			}
+		}
+		if location.Bearer.Introspection && len(location.Bearer.IntrospectionAudiences) == 0 {
+			return errors.New(msg("bearer introspection requires introspection_audiences"))
+		}
+	}
 
 	return nil
 }
 
+var defaultAuthCheckHeaders = map[string]string{
+	"X-Auth-Request-User":  "sub",
+	"X-Auth-Request-Email": "email",
+}
+
+func (s *Servers) GetAuthCheckHeaders() map[string]string {
+	if len(s.AuthCheckHeaders) > 0 {
+		return s.AuthCheckHeaders
+	}
+	return defaultAuthCheckHeaders
+}
+
 func (s *Servers) GetHostname() string {
 	return s.ServerName + ":" + strconv.Itoa(s.Port)
 }
@@ -169,8 +350,167 @@ type Oidc struct {
 	ClientSecret string   `yaml:"client_secret" toml:"client_secret" json:"client_secret"`
 	RedirectUrl  string   `yaml:"redirect_url" toml:"redirect_url" json:"redirect_url"`
 	Logout       string   `yaml:"logout" toml:"logout" json:"logout"`
+	// PostLogoutRedirectUrl IdPでのログアウト後に戻るURL(post_logoutのパス)
+	PostLogoutRedirectUrl string `yaml:"post_logout_redirect_url" toml:"post_logout_redirect_url" json:"post_logout_redirect_url"`
 	// GrantType    string    `yaml:"grant_type" toml:"grant_type" json:"grant_type"`
 	Audiences []string `yaml:"audiences" toml:"audiences" json:"audiences"`
+	Pkce      string   `yaml:"pkce" toml:"pkce" json:"pkce"`
+	// DiscoveryInterval ディスカバリ情報を再取得する間隔(秒)
+	DiscoveryInterval int `yaml:"discovery_interval" toml:"discovery_interval" json:"discovery_interval"`
+	// RefreshSkew トークンの有効期限の何秒前から更新を行うか
+	RefreshSkew int `yaml:"refresh_skew" toml:"refresh_skew" json:"refresh_skew"`
+	// DefaultTokenLifetime トークンレスポンスにexpires_inが含まれない場合のアクセストークンの有効期限(秒)
+	DefaultTokenLifetime int `yaml:"default_token_lifetime" toml:"default_token_lifetime" json:"default_token_lifetime"`
+	// TokenEndpointAuthMethod トークンエンドポイントでのクライアント認証方式
+	TokenEndpointAuthMethod string `yaml:"token_endpoint_auth_method" toml:"token_endpoint_auth_method" json:"token_endpoint_auth_method"`
+	// PrivateKey private_key_jwtで署名に使用する秘密鍵(PEM)のファイル
+	PrivateKey string `yaml:"private_key" toml:"private_key" json:"private_key"`
+	// PrivateKeyId private_key_jwtのJWTヘッダーへ設定するkid
+	PrivateKeyId string `yaml:"private_key_id" toml:"private_key_id" json:"private_key_id"`
+	// Type プロバイダの種類(oidc, oauth2)
+	Type string `yaml:"type" toml:"type" json:"type"`
+	// AuthorizeUrl oauth2の場合の認可エンドポイント
+	AuthorizeUrl string `yaml:"authorize_url" toml:"authorize_url" json:"authorize_url"`
+	// TokenUrl oauth2の場合のトークンエンドポイント
+	TokenUrl string `yaml:"token_url" toml:"token_url" json:"token_url"`
+	// UserinfoUrl oauth2の場合にユーザー情報を取得するエンドポイント
+	UserinfoUrl string `yaml:"userinfo_url" toml:"userinfo_url" json:"userinfo_url"`
+	// SubjectClaim oauth2の場合にsubとして使用するユーザー情報のクレーム(デフォルトsub)
+	SubjectClaim string `yaml:"subject_claim" toml:"subject_claim" json:"subject_claim"`
+	// Introspection アクセストークンの有効性をイントロスペクション(RFC 7662)で確認するか
+	Introspection bool `yaml:"introspection" toml:"introspection" json:"introspection"`
+	// IntrospectionUrl イントロスペクションエンドポイント(未設定の場合はディスカバリ情報から取得)
+	IntrospectionUrl string `yaml:"introspection_url" toml:"introspection_url" json:"introspection_url"`
+	// IntrospectionCacheTtl イントロスペクションの結果をキャッシュする秒数
+	IntrospectionCacheTtl int `yaml:"introspection_cache_ttl" toml:"introspection_cache_ttl" json:"introspection_cache_ttl"`
+}
+
+const (
+	ProviderTypeOidc   = "oidc"
+	ProviderTypeOAuth2 = "oauth2"
+)
+
+// IsOAuth2 IDトークンを発行しないOAuth2のプロバイダかを返します。
+func (o *Oidc) IsOAuth2() bool {
+	return o.Type == ProviderTypeOAuth2
+}
+
+const defaultSubjectClaim = "sub"
+
+func (o *Oidc) GetSubjectClaim() string {
+	if o.SubjectClaim != "" {
+		return o.SubjectClaim
+	}
+	return defaultSubjectClaim
+}
+
+func (o *Oidc) validateType() error {
+	switch o.Type {
+	case "", ProviderTypeOidc:
+	case ProviderTypeOAuth2:
+		if o.AuthorizeUrl == "" || o.TokenUrl == "" || o.UserinfoUrl == "" {
+			return errors.New("oauth2 provider requires authorize_url, token_url and userinfo_url")
+		}
+		if o.Introspection && o.IntrospectionUrl == "" {
+			return errors.New("oauth2 provider requires introspection_url for introspection")
+		}
+		if o.IsPkceRequired() {
+			return errors.New("oauth2 provider cannot advertise PKCE support, use pkce: S256 instead of required")
+		}
+	default:
+		return fmt.Errorf("unsupported provider type: %s", o.Type)
+	}
+	return nil
+}
+
+const (
+	ClientSecretBasic = "client_secret_basic"
+	ClientSecretPost  = "client_secret_post"
+	ClientSecretJwt   = "client_secret_jwt"
+	PrivateKeyJwt     = "private_key_jwt"
+)
+
+// IsClientAssertion クライアント認証にJWT(client_assertion)を使用するかを返します。
+func (o *Oidc) IsClientAssertion() bool {
+	return o.TokenEndpointAuthMethod == ClientSecretJwt || o.TokenEndpointAuthMethod == PrivateKeyJwt
+}
+
+func (o *Oidc) validateClientAuth() error {
+	switch o.TokenEndpointAuthMethod {
+	case "", ClientSecretBasic, ClientSecretPost:
+	case ClientSecretJwt:
+		if o.ClientSecret == "" {
+			return errors.New("client_secret_jwt requires client_secret")
+		}
+	case PrivateKeyJwt:
+		if o.PrivateKey == "" {
+			return errors.New("private_key_jwt requires private_key")
+		}
+	default:
+		return fmt.Errorf("unsupported token_endpoint_auth_method: %s", o.TokenEndpointAuthMethod)
+	}
+	return nil
+}
+
+const defaultRefreshSkew = 60
+
+func (o *Oidc) GetRefreshSkew() time.Duration {
+	if o.RefreshSkew > 0 {
+		return time.Duration(o.RefreshSkew) * time.Second
+	}
+	return defaultRefreshSkew * time.Second
+}
+
+const defaultTokenLifetime = 3600
+
+func (o *Oidc) GetDefaultTokenLifetime() time.Duration {
+	if o.DefaultTokenLifetime > 0 {
+		return time.Duration(o.DefaultTokenLifetime) * time.Second
+	}
+	return defaultTokenLifetime * time.Second
+}
+
+const defaultIntrospectionCacheTtl = 60
+
+func (o *Oidc) GetIntrospectionCacheTtl() time.Duration {
+	if o.IntrospectionCacheTtl > 0 {
+		return time.Duration(o.IntrospectionCacheTtl) * time.Second
+	}
+	return defaultIntrospectionCacheTtl * time.Second
+}
+
+const defaultDiscoveryInterval = 3600
+
+func (o *Oidc) GetDiscoveryInterval() time.Duration {
+	if o.DiscoveryInterval > 0 {
+		return time.Duration(o.DiscoveryInterval) * time.Second
+	}
+	return defaultDiscoveryInterval * time.Second
+}
+
+const (
+	PkceOff      = "off"
+	PkceS256     = "S256"
+	PkceRequired = "required"
+)
+
+// IsPkce 認可リクエストにPKCE(S256)を付与するかを返します。
+func (o *Oidc) IsPkce() bool {
+	return o.Pkce == PkceS256 || o.Pkce == PkceRequired
+}
+
+// IsPkceRequired プロバイダがPKCEに対応していることを必須とするかを返します。
+func (o *Oidc) IsPkceRequired() bool {
+	return o.Pkce == PkceRequired
+}
+
+func (o *Oidc) validatePkce() error {
+	switch o.Pkce {
+	case "", PkceOff, PkceS256, PkceRequired:
+	default:
+		return fmt.Errorf("unsupported pkce: %s", o.Pkce)
+	}
+	return nil
 }
 
 func (o *Oidc) SetValues() []oauth2.AuthCodeOption {
@@ -235,17 +575,208 @@ type Locations struct {
 	ProxyPass      string `yaml:"proxy_pass" toml:"proxy_pass" json:"proxy_pass"`
 	ProxySSLVerify string `yaml:"proxy_ssl_verify" toml:"proxy_ssl_verify" json:"proxy_ssl_verify"`
 	Urls           []Urls `yaml:"urls" toml:"urls" json:"urls"`
+	// Bearer AuthorizationヘッダーのJWTによるアクセスを許可する場合の設定
+	Bearer Bearer `yaml:"bearer" toml:"bearer" json:"bearer"`
+	// Access ロケーション配下の全てのパスに適用するアクセス制御
+	Access Access `yaml:"access" toml:"access" json:"access"`
+	// Headers プロキシ先へ転送するヘッダー名とクレームの対応(例: X-Forwarded-Email: email)
+	Headers map[string]string `yaml:"headers" toml:"headers" json:"headers"`
+	// Impersonation kube-apiserverへユーザーを偽装して転送する場合の設定
+	Impersonation Impersonation `yaml:"impersonation" toml:"impersonation" json:"impersonation"`
+	// TokenExchange セッションのアクセストークンをプロキシ先向けのトークンへ交換する場合の設定(RFC 8693)
+	TokenExchange TokenExchange `yaml:"token_exchange" toml:"token_exchange" json:"token_exchange"`
+	// ClientCredentials ユーザーのトークンの代わりにプロキシ自身のクライアントとして取得したトークンを転送する場合の設定
+	ClientCredentials ClientCredentials `yaml:"client_credentials" toml:"client_credentials" json:"client_credentials"`
+	// PreserveRequest セッション切れで中断したフォームの送信をログイン後に再送する場合の設定
+	PreserveRequest PreserveRequest `yaml:"preserve_request" toml:"preserve_request" json:"preserve_request"`
+	// Unauthenticated サーバーのunauthenticatedをロケーション毎に上書きします
+	Unauthenticated string `yaml:"unauthenticated" toml:"unauthenticated" json:"unauthenticated"`
 }
 
 func (l *Locations) IsProxySSLVerify() bool {
 	return l.ProxySSLVerify == "on"
 }
 
+// Bearer
+type Bearer struct {
+	// Issuers 信頼するトークンの発行者
+	Issuers []TrustedIssuer `yaml:"issuers" toml:"issuers" json:"issuers"`
+	// Token 設定されている場合、検証したトークンの代わりにこのトークンをプロキシ先へ転送します
+	Token string `yaml:"token" toml:"token" json:"token"`
+	// Introspection 信頼する発行者のJWT以外のトークンをIdPのイントロスペクションで検証します
+	Introspection bool `yaml:"introspection" toml:"introspection" json:"introspection"`
+	// IntrospectionAudiences イントロスペクションで検証したトークンに許可するaudまたはclient_id
+	IntrospectionAudiences []string `yaml:"introspection_audiences" toml:"introspection_audiences" json:"introspection_audiences"`
+}
+
+// IsEnabled ベアラートークンによるアクセスを許可するかを返します。
+func (b *Bearer) IsEnabled() bool {
+	return len(b.Issuers) > 0 || b.Introspection
+}
+
+// TrustedIssuer
+type TrustedIssuer struct {
+	Issuer    string   `yaml:"issuer" toml:"issuer" json:"issuer"`
+	Audiences []string `yaml:"audiences" toml:"audiences" json:"audiences"`
+	// JwksUri 未設定の場合はディスカバリ情報から取得します
+	JwksUri string `yaml:"jwks_uri" toml:"jwks_uri" json:"jwks_uri"`
+	// SigningAlgs 許可する署名アルゴリズム。未設定の場合はディスカバリ情報から取得します
+	SigningAlgs []string `yaml:"signing_algs" toml:"signing_algs" json:"signing_algs"`
+}
+
+// ClientCredentials
+type ClientCredentials struct {
+	ClientId     string   `yaml:"client_id" toml:"client_id" json:"client_id"`
+	ClientSecret string   `yaml:"client_secret" toml:"client_secret" json:"client_secret"`
+	Scopes       []string `yaml:"scopes" toml:"scopes" json:"scopes"`
+	// TokenUrl トークンエンドポイント(未設定の場合はoidc.providerのトークンエンドポイント)
+	TokenUrl string `yaml:"token_url" toml:"token_url" json:"token_url"`
+	// EndpointParams トークンリクエストへ追加するパラメータ(例: audience)
+	EndpointParams map[string]string `yaml:"endpoint_params" toml:"endpoint_params" json:"endpoint_params"`
+	// Provider token_urlが未設定の場合にトークンエンドポイントを使用するIdPの名前(未設定の場合は先頭のIdP)
+	Provider string `yaml:"provider" toml:"provider" json:"provider"`
+}
+
+// IsEnabled クライアントクレデンシャルのトークンを転送するかを返します。
+func (c *ClientCredentials) IsEnabled() bool {
+	return c.ClientId != ""
+}
+
+// PreserveRequest
+// application/x-www-form-urlencodedのPOSTのみが対象です。
+type PreserveRequest struct {
+	Enabled bool `yaml:"enabled" toml:"enabled" json:"enabled"`
+	// MaxBodySize 保存するリクエストボディの上限(バイト)。超える場合は保存しません
+	MaxBodySize int64 `yaml:"max_body_size" toml:"max_body_size" json:"max_body_size"`
+}
+
+const defaultPreserveMaxBodySize = 64 * 1024
+
+func (p *PreserveRequest) GetMaxBodySize() int64 {
+	if p.MaxBodySize > 0 {
+		return p.MaxBodySize
+	}
+	return defaultPreserveMaxBodySize
+}
+
+// TokenExchange
+type TokenExchange struct {
+	Audience string   `yaml:"audience" toml:"audience" json:"audience"`
+	Resource string   `yaml:"resource" toml:"resource" json:"resource"`
+	Scopes   []string `yaml:"scopes" toml:"scopes" json:"scopes"`
+	// RequestedTokenType 要求するトークンの種類(未設定の場合はIdPの既定値)
+	RequestedTokenType string `yaml:"requested_token_type" toml:"requested_token_type" json:"requested_token_type"`
+}
+
+// IsEnabled トークン交換を行うかを返します。
+func (t *TokenExchange) IsEnabled() bool {
+	return t.Audience != "" || t.Resource != ""
+}
+
+// Impersonation
+// プロキシ自身の認証情報でkube-apiserverへ接続し、クレームから生成したImpersonate-*ヘッダーを付与します。
+type Impersonation struct {
+	Enabled      bool     `yaml:"enabled" toml:"enabled" json:"enabled"`
+	UserClaim    string   `yaml:"user_claim" toml:"user_claim" json:"user_claim"`
+	UserPrefix   string   `yaml:"user_prefix" toml:"user_prefix" json:"user_prefix"`
+	GroupsClaim  string   `yaml:"groups_claim" toml:"groups_claim" json:"groups_claim"`
+	GroupsPrefix string   `yaml:"groups_prefix" toml:"groups_prefix" json:"groups_prefix"`
+	ExtraClaims  []string `yaml:"extra_claims" toml:"extra_claims" json:"extra_claims"`
+	// TokenFile kube-apiserverへの認証に使用するトークンのファイル(未設定かつクライアント証明書も未設定の場合はServiceAccountのトークン)
+	TokenFile  string `yaml:"token_file" toml:"token_file" json:"token_file"`
+	ClientCert string `yaml:"client_cert" toml:"client_cert" json:"client_cert"`
+	ClientKey  string `yaml:"client_key" toml:"client_key" json:"client_key"`
+	// CaFile kube-apiserverのサーバー証明書を検証するCA証明書
+	CaFile string `yaml:"ca_file" toml:"ca_file" json:"ca_file"`
+}
+
+const (
+	defaultImpersonationUserClaim = "sub"
+	serviceAccountTokenFile       = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+func (i *Impersonation) GetUserClaim() string {
+	if i.UserClaim != "" {
+		return i.UserClaim
+	}
+	return defaultImpersonationUserClaim
+}
+
+func (i *Impersonation) GetGroupsClaim() string {
+	if i.GroupsClaim != "" {
+		return i.GroupsClaim
+	}
+	return defaultGroupsClaim
+}
+
+func (i *Impersonation) GetTokenFile() string {
+	if i.TokenFile == "" && i.ClientCert == "" {
+		return serviceAccountTokenFile
+	}
+	return i.TokenFile
+}
+
 // Urls
 type Urls struct {
 	Path  string `yaml:"path" toml:"path" json:"path"`
 	Token string `yaml:"token" toml:"token" json:"token"`
 	Type  string `yaml:"type" toml:"type" json:"type"`
+	// Access パス毎のアクセス制御(ロケーションのアクセス制御と併せて判定されます)
+	Access Access `yaml:"access" toml:"access" json:"access"`
+	// Acr 要求する認証コンテキストクラス(IDトークンのacrがいずれかに一致する必要があります)
+	Acr []string `yaml:"acr" toml:"acr" json:"acr"`
+	// MaxAge ログインからの経過時間の上限(秒)
+	MaxAge int `yaml:"max_age" toml:"max_age" json:"max_age"`
+}
+
+// RequiresStepUp acrまたはログインからの経過時間を要求するかを返します。
+func (u *Urls) RequiresStepUp() bool {
+	return len(u.Acr) > 0 || u.MaxAge > 0
+}
+
+func (u *Urls) GetMaxAge() time.Duration {
+	return time.Duration(u.MaxAge) * time.Second
+}
+
+// Access
+// 設定された条件は全て満たす必要があります。
+// groups, roles, email_domains, subjectsはいずれか1つに一致すれば許可され、scopesは全て必要です。
+type Access struct {
+	Groups []string `yaml:"groups" toml:"groups" json:"groups"`
+	// GroupsClaim グループを取得するクレーム(ネストしたクレームは.で区切る)
+	GroupsClaim string   `yaml:"groups_claim" toml:"groups_claim" json:"groups_claim"`
+	Roles       []string `yaml:"roles" toml:"roles" json:"roles"`
+	// RolesClaim ロールを取得するクレーム(例: realm_access.roles)
+	RolesClaim   string   `yaml:"roles_claim" toml:"roles_claim" json:"roles_claim"`
+	EmailDomains []string `yaml:"email_domains" toml:"email_domains" json:"email_domains"`
+	// AllowUnverifiedEmail email_verifiedがfalseまたは含まれないメールアドレスをemail_domainsで許可するか
+	AllowUnverifiedEmail bool     `yaml:"allow_unverified_email" toml:"allow_unverified_email" json:"allow_unverified_email"`
+	Subjects             []string `yaml:"subjects" toml:"subjects" json:"subjects"`
+	Scopes               []string `yaml:"scopes" toml:"scopes" json:"scopes"`
+}
+
+const (
+	defaultGroupsClaim = "groups"
+	defaultRolesClaim  = "roles"
+)
+
+// IsEnabled アクセス制御の条件が設定されているかを返します。
+func (a *Access) IsEnabled() bool {
+	return len(a.Groups) > 0 || len(a.Roles) > 0 || len(a.EmailDomains) > 0 || len(a.Subjects) > 0 || len(a.Scopes) > 0
+}
+
+func (a *Access) GetGroupsClaim() string {
+	if a.GroupsClaim != "" {
+		return a.GroupsClaim
+	}
+	return defaultGroupsClaim
+}
+
+func (a *Access) GetRolesClaim() string {
+	if a.RolesClaim != "" {
+		return a.RolesClaim
+	}
+	return defaultRolesClaim
 }
 
 // Logging
@@ -3,46 +3,101 @@ package framework
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"log"
 	mrand "math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/e2e/utils"
 	"golang.org/x/oauth2/jws"
 	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
 )
 
 const letters = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
+// Subject 発行するIDトークンのsubです。
+const Subject = "oidc-proxy-user"
+
+// OpaqueToken イントロスペクションで有効と判定されるJWT形式ではないAPIクライアントのトークンです。
+const OpaqueToken = "opaque-api-token"
+
+// ForeignOpaqueToken イントロスペクションで有効と判定される他のクライアント向けのトークンです。
+const ForeignOpaqueToken = "foreign-api-token"
+
 type provider struct {
-	Issuer                string `json:"issuer"`
-	AuthorizationEndpoint string `json:"authorization_endpoint"`
-	TokenEndpoint         string `json:"token_endpoint"`
-	JWKSEndpoint          string `json:"jwks_uri"`
-	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	Issuer                string   `json:"issuer"`
+	AuthorizationEndpoint string   `json:"authorization_endpoint"`
+	TokenEndpoint         string   `json:"token_endpoint"`
+	JWKSEndpoint          string   `json:"jwks_uri"`
+	UserInfoEndpoint      string   `json:"userinfo_endpoint"`
+	CodeChallengeMethods  []string `json:"code_challenge_methods_supported"`
+	EndSessionEndpoint    string   `json:"end_session_endpoint"`
+	IntrospectionEndpoint string   `json:"introspection_endpoint"`
 }
 
 type token struct {
 	AccessToken  string `json:"access_token"`
 	TokenType    string `json:"token_type"`
 	RefreshToken string `json:"refresh_token"`
-	ExpiresIn    int    `json:"expires_in"`
-	IdToken      string `json:"id_token"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+	IdToken      string `json:"id_token,omitempty"`
 }
 
 type IdentityProvider struct {
 	*http.Server
-	Issuer         string
-	PrivateKey     *rsa.PrivateKey
-	codes          map[string]struct{}
+	Issuer     string
+	PrivateKey *rsa.PrivateKey
+	// ForceNonce 設定されている場合、認可リクエストのnonceではなくこの値をIDトークンへ設定します。
+	ForceNonce string
+	// ExpiresIn 発行するアクセストークンの有効期限(秒)
+	ExpiresIn int
+	// IDTokenExpiresIn 発行するIDトークンの有効期限(秒)。未設定の場合は1時間です。
+	IDTokenExpiresIn int
+	// IgnoreAcrValues 設定されている場合、要求されたacr_valuesを無視してパスワード認証のacrを発行します。
+	IgnoreAcrValues bool
+	// OmitIDToken 設定されている場合、IDトークンを発行しないOAuth2のプロバイダとして振る舞います。
+	OmitIDToken bool
+	// IntrospectionStatus 設定されている場合、イントロスペクションエンドポイントはこのステータスコードを返します。
+	IntrospectionStatus int
+	// OmitRefreshToken 設定されている場合、GitHubのOAuth Appsと同様にリフレッシュトークンを発行しません。
+	OmitRefreshToken bool
+	// clientKey 登録されている場合、トークンエンドポイントでprivate_key_jwtのクライアント認証を要求します。
+	clientKey      *rsa.PublicKey
+	assertions     int
+	jtis           map[string]bool
+	refreshes      int32
+	exchanges      int32
+	clientGrants   int32
+	introspections int32
+	jwksRequests   int32
+	revoked        map[string]bool
+	lastSid        string
+	mu             sync.Mutex
+	codes          map[string]*authRequest
 	idleConnsClose chan struct{}
 }
 
+type authRequest struct {
+	nonce               string
+	acr                 string
+	codeChallenge       string
+	codeChallengeMethod string
+}
+
 type context struct {
 	writer http.ResponseWriter
 	req    *http.Request
@@ -64,7 +119,9 @@ func NewIdpServer(idleConnsClose chan struct{}) (*IdentityProvider, error) {
 	idp := &IdentityProvider{
 		Issuer:     issuer,
 		PrivateKey: privateKey,
-		codes:      map[string]struct{}{},
+		codes:      map[string]*authRequest{},
+		jtis:       map[string]bool{},
+		revoked:    map[string]bool{},
 	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, r *http.Request) {
@@ -73,6 +130,10 @@ func NewIdpServer(idleConnsClose chan struct{}) (*IdentityProvider, error) {
 			AuthorizationEndpoint: issuer + "/authorize",
 			TokenEndpoint:         issuer + "/oauth/token",
 			JWKSEndpoint:          issuer + "/.well-known/jwks.json",
+			CodeChallengeMethods:  []string{"S256"},
+			EndSessionEndpoint:    issuer + "/v2/logout",
+			IntrospectionEndpoint: issuer + "/oauth/introspect",
+			UserInfoEndpoint:      issuer + "/userinfo",
 		}
 		if err := json.NewEncoder(rw).Encode(p); err != nil {
 			return
@@ -82,6 +143,10 @@ func NewIdpServer(idleConnsClose chan struct{}) (*IdentityProvider, error) {
 	mux.HandleFunc("/u/login", idp.middleware(idp.handlerLogin))
 	mux.HandleFunc("/oauth/token", idp.middleware(idp.handleToken))
 	mux.HandleFunc("/.well-known/jwks.json", idp.middleware(idp.handleJWKS))
+	mux.HandleFunc("/v2/logout", idp.middleware(idp.handleEndSession))
+	mux.HandleFunc("/user", idp.middleware(idp.handleUserInfo))
+	mux.HandleFunc("/userinfo", idp.middleware(idp.handleOidcUserInfo))
+	mux.HandleFunc("/oauth/introspect", idp.middleware(idp.handleIntrospect))
 
 	idp.Server = &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
@@ -135,14 +200,23 @@ func (i *IdentityProvider) handlerLogin(c *context) {
 		return
 	}
 
-	code := make([]byte, 16)
-	for i := range code {
-		code[i] = letters[mrand.Intn(len(letters))]
+	// prompt=loginで再認証した場合はacr_valuesの先頭の認証方式で認証したものとする
+	acr := "pwd"
+	if acrValues := strings.Fields(q.Get("acr_values")); len(acrValues) > 0 && q.Get("prompt") == "login" && !i.IgnoreAcrValues {
+		acr = acrValues[0]
+	}
+	code := randomString(16)
+	i.mu.Lock()
+	i.codes[code] = &authRequest{
+		nonce:               q.Get("nonce"),
+		acr:                 acr,
+		codeChallenge:       q.Get("code_challenge"),
+		codeChallengeMethod: q.Get("code_challenge_method"),
 	}
-	i.codes[string(code)] = struct{}{}
+	i.mu.Unlock()
 	rq := redirectURL.Query()
 	rq.Set("state", q.Get("state"))
-	rq.Set("code", string(code))
+	rq.Set("code", code)
 	redirectURL.RawQuery = rq.Encode()
 	w.Header().Set("Location", redirectURL.String())
 	w.WriteHeader(http.StatusSeeOther)
@@ -157,17 +231,70 @@ func (i *IdentityProvider) handleToken(c *context) {
 		return
 	}
 
+	if grantType := r.FormValue("grant_type"); grantType != "client_credentials" {
+		if err := i.authenticateClient(r); err != nil {
+			log.Printf("client authentication: %v", err)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+	}
+
+	switch r.FormValue("grant_type") {
+	case "refresh_token":
+		i.handleRefreshToken(c)
+		return
+	case "urn:ietf:params:oauth:grant-type:token-exchange":
+		i.handleTokenExchange(c)
+		return
+	case "client_credentials":
+		i.handleClientCredentials(c)
+		return
+	}
+
 	gotCode := r.FormValue("code")
-	if _, ok := i.codes[gotCode]; !ok {
+	i.mu.Lock()
+	req, ok := i.codes[gotCode]
+	delete(i.codes, gotCode)
+	i.mu.Unlock()
+	if !ok {
 		log.Print("Unknown code")
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	if !req.verifyCodeChallenge(r.FormValue("code_verifier")) {
+		log.Print("Invalid code_verifier")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
 
+	claims := map[string]interface{}{
+		"email":     "oidc-proxy-ecosystem@n-creativesystem.dev",
+		"acr":       req.acr,
+		"auth_time": time.Now().Unix(),
+	}
+	nonce := req.nonce
+	if i.ForceNonce != "" {
+		nonce = i.ForceNonce
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	sid := randomString(16)
+	claims["sid"] = sid
+	i.mu.Lock()
+	i.lastSid = sid
+	i.mu.Unlock()
 	cs := &jws.ClaimSet{
 		Iss:           i.Issuer,
 		Aud:           "oidc-proxy-ecosystem-provider",
-		PrivateClaims: map[string]interface{}{"email": "oidc-proxy-ecosystem@n-creativesystem.dev"},
+		Sub:           Subject,
+		PrivateClaims: claims,
+	}
+	if i.IDTokenExpiresIn > 0 {
+		cs.Iat = time.Now().Unix()
+		cs.Exp = cs.Iat + int64(i.IDTokenExpiresIn)
 	}
 	idToken, err := jws.Encode(&jws.Header{Algorithm: "RS256", KeyID: "idp"}, cs, i.PrivateKey)
 	if err != nil {
@@ -180,8 +307,15 @@ func (i *IdentityProvider) handleToken(c *context) {
 	token := &token{
 		AccessToken:  "accesstoken",
 		RefreshToken: "refreshtoken",
+		ExpiresIn:    i.ExpiresIn,
 		IdToken:      idToken,
 	}
+	if i.OmitIDToken {
+		token.IdToken = ""
+	}
+	if i.OmitRefreshToken {
+		token.RefreshToken = ""
+	}
 	if err := json.NewEncoder(w).Encode(token); err != nil {
 		log.Print(err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -189,8 +323,354 @@ func (i *IdentityProvider) handleToken(c *context) {
 	}
 }
 
+// handleRefreshToken IDトークンを再発行しないIdPとしてアクセストークンのみを更新します。
+func (i *IdentityProvider) handleRefreshToken(c *context) {
+	w := c.writer
+	r := c.req
+	if r.FormValue("refresh_token") != "refreshtoken" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+	atomic.AddInt32(&i.refreshes, 1)
+	w.Header().Set("Content-Type", "application/json")
+	token := &token{
+		AccessToken: "refreshedaccesstoken",
+		TokenType:   "Bearer",
+		ExpiresIn:   3600,
+	}
+	if err := json.NewEncoder(w).Encode(token); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleTokenExchange アクセストークンをaudience毎のアクセストークンへ交換します(RFC 8693)。
+func (i *IdentityProvider) handleTokenExchange(c *context) {
+	w := c.writer
+	r := c.req
+	w.Header().Set("Content-Type", "application/json")
+	if r.FormValue("subject_token") == "" || r.FormValue("subject_token_type") != "urn:ietf:params:oauth:token-type:access_token" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_request"}`))
+		return
+	}
+	audience := r.FormValue("audience")
+	if audience == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_target"}`))
+		return
+	}
+	atomic.AddInt32(&i.exchanges, 1)
+	res := map[string]interface{}{
+		"access_token":      "exchanged-" + audience,
+		"issued_token_type": "urn:ietf:params:oauth:token-type:access_token",
+		"token_type":        "Bearer",
+		"expires_in":        3600,
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleClientCredentials クライアント自身のアクセストークンを発行します。
+func (i *IdentityProvider) handleClientCredentials(c *context) {
+	w := c.writer
+	r := c.req
+	w.Header().Set("Content-Type", "application/json")
+	clientID, _, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.FormValue("client_id")
+	}
+	if clientID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"invalid_client"}`))
+		return
+	}
+	atomic.AddInt32(&i.clientGrants, 1)
+	token := &token{
+		AccessToken: "machine-" + clientID,
+		TokenType:   "Bearer",
+		ExpiresIn:   3600,
+	}
+	if err := json.NewEncoder(w).Encode(token); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// ClientCredentialsGrants クライアントクレデンシャルによるトークン発行の回数を返します。
+func (i *IdentityProvider) ClientCredentialsGrants() int {
+	return int(atomic.LoadInt32(&i.clientGrants))
+}
+
+// RegisterClientKey クライアントの秘密鍵を生成してfilenameへ書き込み、公開鍵を登録します。
+// 登録後はトークンエンドポイントでprivate_key_jwtのクライアント認証を要求します。
+func (i *IdentityProvider) RegisterClientKey(filename string) error {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	i.clientKey = &privateKey.PublicKey
+	i.mu.Unlock()
+	return nil
+}
+
+// authenticateClient client_assertionの署名・iss・sub・aud・有効期限・jtiの再利用を検証します。
+func (i *IdentityProvider) authenticateClient(r *http.Request) error {
+	i.mu.Lock()
+	clientKey := i.clientKey
+	i.mu.Unlock()
+	if clientKey == nil {
+		return nil
+	}
+	if _, _, ok := r.BasicAuth(); ok || r.FormValue("client_secret") != "" {
+		return fmt.Errorf("client secret must not be sent")
+	}
+	if r.FormValue("client_assertion_type") != "urn:ietf:params:oauth:client-assertion-type:jwt-bearer" {
+		return fmt.Errorf("invalid client_assertion_type")
+	}
+	token, err := jwt.ParseSigned(r.FormValue("client_assertion"))
+	if err != nil {
+		return err
+	}
+	var claims jwt.Claims
+	if err := token.Claims(clientKey, &claims); err != nil {
+		return err
+	}
+	clientID := r.FormValue("client_id")
+	if err := claims.Validate(jwt.Expected{
+		Issuer:   clientID,
+		Subject:  clientID,
+		Audience: jwt.Audience{i.Issuer + "/oauth/token"},
+	}); err != nil {
+		return err
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if claims.ID == "" || i.jtis[claims.ID] {
+		return fmt.Errorf("client_assertion jti replayed")
+	}
+	i.jtis[claims.ID] = true
+	i.assertions++
+	return nil
+}
+
+// ClientAssertions 検証したクライアント認証のJWTの数を返します。
+func (i *IdentityProvider) ClientAssertions() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.assertions
+}
+
+// Exchanges トークン交換の回数を返します。
+func (i *IdentityProvider) Exchanges() int {
+	return int(atomic.LoadInt32(&i.exchanges))
+}
+
+// handleUserInfo GitHubのユーザーAPIと同様に数値のidを含むユーザー情報を返します。
+// Revokeで無効化されたトークンは401を返します。
+func (i *IdentityProvider) handleUserInfo(c *context) {
+	w := c.writer
+	r := c.req
+	i.mu.Lock()
+	revoked := i.revoked[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	i.mu.Unlock()
+	switch r.Header.Get("Authorization") {
+	case "Bearer accesstoken", "Bearer refreshedaccesstoken":
+		if revoked {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":    583231,
+		"login": "octocat",
+		"email": "octocat@github.example.com",
+	})
+}
+
+// handleOidcUserInfo OpenID Connectのユーザー情報エンドポイントです。
+func (i *IdentityProvider) handleOidcUserInfo(c *context) {
+	w := c.writer
+	r := c.req
+	switch r.Header.Get("Authorization") {
+	case "Bearer accesstoken", "Bearer refreshedaccesstoken":
+	default:
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sub":   Subject,
+		"name":  "OIDC Proxy User",
+		"email": "user@example.com",
+	})
+}
+
+// handleIntrospect 発行したアクセストークンとOpaqueToken, ForeignOpaqueTokenを有効なトークンとして返します(RFC 7662)。
+// Revokeで無効化されたトークンはactive=falseを返します。
+func (i *IdentityProvider) handleIntrospect(c *context) {
+	w := c.writer
+	r := c.req
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := i.authenticateClient(r); err != nil {
+		log.Printf("client authentication: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"invalid_client"}`))
+		return
+	}
+	atomic.AddInt32(&i.introspections, 1)
+	if i.IntrospectionStatus != 0 {
+		w.WriteHeader(i.IntrospectionStatus)
+		w.Write([]byte(`{"error":"introspection failed"}`))
+		return
+	}
+	token := r.FormValue("token")
+	i.mu.Lock()
+	revoked := i.revoked[token]
+	i.mu.Unlock()
+	res := map[string]interface{}{"active": false}
+	switch token {
+	case "accesstoken", "refreshedaccesstoken", OpaqueToken:
+		if revoked {
+			break
+		}
+		res = map[string]interface{}{
+			"active":     true,
+			"sub":        Subject,
+			"client_id":  "oidc-proxy-ecosystem-provider",
+			"scope":      "openid email orders.read",
+			"token_type": "Bearer",
+			"exp":        time.Now().Add(time.Hour).Unix(),
+		}
+	case ForeignOpaqueToken:
+		res = map[string]interface{}{
+			"active":     true,
+			"sub":        Subject,
+			"aud":        []string{"other-api"},
+			"client_id":  "other-client",
+			"token_type": "Bearer",
+			"exp":        time.Now().Add(time.Hour).Unix(),
+		}
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+}
+
+// Revoke トークンを無効化し、以降のイントロスペクションでactive=falseを返します。
+func (i *IdentityProvider) Revoke(token string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.revoked[token] = true
+}
+
+// Introspections イントロスペクションの回数を返します。
+func (i *IdentityProvider) Introspections() int {
+	return int(atomic.LoadInt32(&i.introspections))
+}
+
+// JWKSRequests JWKSの取得回数を返します。
+func (i *IdentityProvider) JWKSRequests() int {
+	return int(atomic.LoadInt32(&i.jwksRequests))
+}
+
+// Refreshes リフレッシュトークンによるトークン更新の回数を返します。
+func (i *IdentityProvider) Refreshes() int {
+	return int(atomic.LoadInt32(&i.refreshes))
+}
+
+// LastSessionID 最後に発行したIDトークンのsidを返します。
+func (i *IdentityProvider) LastSessionID() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.lastSid
+}
+
+// AccessToken audを指定したJWT形式のアクセストークンを発行します。
+func (i *IdentityProvider) AccessToken(aud string) (string, error) {
+	cs := &jws.ClaimSet{
+		Iss: i.Issuer,
+		Aud: aud,
+		Sub: Subject,
+	}
+	return jws.Encode(&jws.Header{Algorithm: "RS256", KeyID: "idp"}, cs, i.PrivateKey)
+}
+
+// LogoutToken Back-Channel Logoutで送信するログアウトトークンを発行します。
+// sidが空の場合はsubのみを含みます。
+func (i *IdentityProvider) LogoutToken(sub, sid string) (string, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	claims := map[string]interface{}{
+		"jti": hex.EncodeToString(jti),
+		"events": map[string]interface{}{
+			"http://schemas.openid.net/event/backchannel-logout": map[string]interface{}{},
+		},
+	}
+	if sid != "" {
+		claims["sid"] = sid
+	}
+	cs := &jws.ClaimSet{
+		Iss:           i.Issuer,
+		Aud:           "oidc-proxy-ecosystem-provider",
+		Sub:           sub,
+		PrivateClaims: claims,
+	}
+	return jws.Encode(&jws.Header{Algorithm: "RS256", KeyID: "idp"}, cs, i.PrivateKey)
+}
+
+func (i *IdentityProvider) handleEndSession(c *context) {
+	w := c.writer
+	r := c.req
+	q := r.URL.Query()
+	if err := jws.Verify(q.Get("id_token_hint"), &i.PrivateKey.PublicKey); err != nil {
+		log.Print("Invalid id_token_hint")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	redirectURL, err := url.Parse(q.Get("post_logout_redirect_uri"))
+	if err != nil || redirectURL.String() == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	rq := redirectURL.Query()
+	if state := q.Get("state"); state != "" {
+		rq.Set("state", state)
+	}
+	redirectURL.RawQuery = rq.Encode()
+	http.Redirect(w, r, redirectURL.String(), http.StatusFound)
+}
+
 func (i *IdentityProvider) handleJWKS(c *context) {
 	w := c.writer
+	atomic.AddInt32(&i.jwksRequests, 1)
 	jwks := &jose.JSONWebKeySet{
 		Keys: []jose.JSONWebKey{
 			{Key: i.PrivateKey.Public(), KeyID: "idp"},
@@ -202,3 +682,23 @@ func (i *IdentityProvider) handleJWKS(c *context) {
 		return
 	}
 }
+
+func (a *authRequest) verifyCodeChallenge(verifier string) bool {
+	switch a.codeChallengeMethod {
+	case "":
+		return a.codeChallenge == "" && verifier == ""
+	case "S256":
+		sum := sha256.Sum256([]byte(verifier))
+		return base64.RawURLEncoding.EncodeToString(sum[:]) == a.codeChallenge
+	default:
+		return false
+	}
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = letters[mrand.Intn(len(letters))]
+	}
+	return string(b)
+}
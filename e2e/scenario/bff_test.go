@@ -0,0 +1,222 @@
+package scenario_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/e2e/framework"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/e2e/utils"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/routes"
+	"github.com/stretchr/testify/assert"
+)
+
+const bffYAML = `
+servers:
+  - server_name: bff
+    port: 8080
+    cookie_name: session
+    login: "/oauth2/login"
+    callback: "/oauth2/callback"
+    logout: "/oauth2/logout"
+    redirect: true
+    bff:
+      userinfo: "/bff/userinfo"
+      session: "/bff/session"
+      token: "/bff/token"
+      token_exchange:
+        audience: "https://orders.example.com"
+      allowed_origins:
+        - "https://app.example.com"
+    oidc:
+      provider: http://127.0.0.1
+      client_id: "oidc-proxy-ecosystem-provider"
+      client_secret: "test"
+      scopes:
+        - email
+        - openid
+    locations:
+      - proxy_pass: http://127.0.0.1
+        urls:
+          - path: /
+            token: "id_token"
+            type: Bearer
+    logging:
+      level: info
+      logformat: "standard"
+      timeformat: "datetime"
+    session:
+      name: "memory"
+      plugin: false
+      codecs:
+        - "something-very-secret"
+`
+
+func TestBff(t *testing.T) {
+	filename := "/tmp/bff.yaml"
+	if !assert.NoError(t, ioutil.WriteFile(filename, []byte(bffYAML), 0600)) {
+		return
+	}
+	defer os.Remove(filename)
+	conf, err := config.New(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	idleConnsClose := make(chan struct{})
+	resourcePort, _ := utils.FindPort()
+	server := buildServer(resourcePort)
+	l, err := net.Listen("tcp", server.Addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	go func() {
+		server.Serve(l)
+		close(idleConnsClose)
+	}()
+	idpConnsClose := make(chan struct{})
+	idp, err := framework.NewIdpServer(idpConnsClose)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	proxyPort, _ := utils.FindPort()
+	srv, err := routes.New(func() config.Servers {
+		confSrv := *conf.Servers[0]
+		confSrv.Oidc.Provider = idp.Issuer
+		confSrv.Oidc.RedirectUrl = fmt.Sprintf("http://127.0.0.1:%d/oauth2/callback", proxyPort)
+		confSrv.Locations = append([]config.Locations{}, confSrv.Locations...)
+		confSrv.Locations[0].ProxyPass = fmt.Sprintf("http://127.0.0.1:%d", resourcePort)
+		return confSrv
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxyConnsClose := make(chan struct{})
+	proxyServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", proxyPort),
+		Handler: srv,
+	}
+	proxyListen, _ := net.Listen("tcp", proxyServer.Addr)
+	go func() {
+		proxyServer.Serve(proxyListen)
+		close(proxyConnsClose)
+	}()
+	defer func() {
+		idp.Shutdown(context.Background())
+		<-idpConnsClose
+		server.Shutdown(context.Background())
+		<-idleConnsClose
+		proxyServer.Shutdown(context.Background())
+		<-proxyConnsClose
+	}()
+	proxyURL := func(url string) string {
+		return fmt.Sprintf("http://127.0.0.1:%d/%s", proxyPort, url)
+	}
+
+	client := &http.Client{
+		Transport: &mockTransport{rt: http.DefaultTransport.RoundTrip},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Path == "/" {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	do := func(method, path string, header map[string]string) (*http.Response, map[string]interface{}) {
+		req, _ := http.NewRequest(method, proxyURL(path), nil)
+		for key, value := range header {
+			req.Header.Set(key, value)
+		}
+		res, err := client.Do(req)
+		if !assert.NoError(t, err) {
+			return nil, nil
+		}
+		defer res.Body.Close()
+		var body map[string]interface{}
+		json.NewDecoder(res.Body).Decode(&body)
+		return res, body
+	}
+	xhr := map[string]string{"X-Requested-With": "XMLHttpRequest"}
+
+	t.Run("not logged in", func(t *testing.T) {
+		res, _ := do(http.MethodGet, "bff/userinfo", nil)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+		assert.Equal(t, "/oauth2/login", res.Header.Get("Location"))
+		assert.Equal(t, `Bearer realm="bff"`, res.Header.Get("WWW-Authenticate"))
+		res, _ = do(http.MethodGet, "bff/session", nil)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	})
+
+	res, err := client.Get(proxyURL("oauth2/login"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	res.Body.Close()
+
+	t.Run("userinfo", func(t *testing.T) {
+		res, body := do(http.MethodGet, "bff/userinfo", nil)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "no-store", res.Header.Get("Cache-Control"))
+		claims, _ := body["claims"].(map[string]interface{})
+		assert.Equal(t, framework.Subject, claims["sub"])
+		userinfo, _ := body["userinfo"].(map[string]interface{})
+		assert.Equal(t, "user@example.com", userinfo["email"])
+	})
+	t.Run("session", func(t *testing.T) {
+		res, body := do(http.MethodGet, "bff/session", nil)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, true, body["authenticated"])
+		assert.Equal(t, framework.Subject, body["sub"])
+		assert.Equal(t, true, body["refreshable"])
+		assert.NotZero(t, body["expires_at"])
+
+		// 同一オリジンの確認ができない更新は拒否する
+		refreshes := idp.Refreshes()
+		res, _ = do(http.MethodPost, "bff/session", nil)
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+		res, _ = do(http.MethodPost, "bff/session", map[string]string{"X-Requested-With": "XMLHttpRequest", "Origin": "https://evil.example.com"})
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+		assert.Equal(t, refreshes, idp.Refreshes())
+
+		res, body = do(http.MethodPost, "bff/session", xhr)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, true, body["authenticated"])
+		assert.Equal(t, refreshes+1, idp.Refreshes())
+	})
+	t.Run("token", func(t *testing.T) {
+		res, _ := do(http.MethodGet, "bff/token", nil)
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+
+		res, body := do(http.MethodGet, "bff/token", map[string]string{"X-Requested-With": "XMLHttpRequest", "Origin": fmt.Sprintf("http://127.0.0.1:%d", proxyPort)})
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "exchanged-https://orders.example.com", body["access_token"])
+		assert.Equal(t, "Bearer", body["token_type"])
+		assert.NotZero(t, body["expires_in"])
+
+		// allowed_originsのオリジンにはCORSで応答する
+		res, _ = do(http.MethodOptions, "bff/token", map[string]string{"Origin": "https://app.example.com", "Access-Control-Request-Method": "GET", "Access-Control-Request-Headers": "x-requested-with"})
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+		assert.Equal(t, "https://app.example.com", res.Header.Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "true", res.Header.Get("Access-Control-Allow-Credentials"))
+		assert.Equal(t, "X-Requested-With", res.Header.Get("Access-Control-Allow-Headers"))
+		res, _ = do(http.MethodOptions, "bff/token", map[string]string{"Origin": "https://evil.example.com", "Access-Control-Request-Method": "GET"})
+		assert.Equal(t, http.StatusForbidden, res.StatusCode)
+		assert.Empty(t, res.Header.Get("Access-Control-Allow-Origin"))
+		res, body = do(http.MethodGet, "bff/token", map[string]string{"X-Requested-With": "XMLHttpRequest", "Origin": "https://app.example.com"})
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, "https://app.example.com", res.Header.Get("Access-Control-Allow-Origin"))
+
+		// 交換したトークンは有効期限までセッションから返す
+		exchanges := idp.Exchanges()
+		res, _ = do(http.MethodPost, "bff/token", xhr)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, exchanges, idp.Exchanges())
+	})
+}
@@ -0,0 +1,206 @@
+package scenario_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/e2e/framework"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/e2e/utils"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/routes"
+	"github.com/stretchr/testify/assert"
+)
+
+const introspectionYAML = `
+servers:
+  - server_name: introspection
+    port: 8080
+    cookie_name: session
+    login: "/oauth2/login"
+    callback: "/oauth2/callback"
+    logout: "/oauth2/logout"
+    redirect: true
+    oidc:
+      provider: http://127.0.0.1
+      client_id: "oidc-proxy-ecosystem-provider"
+      client_secret: "test"
+      introspection: true
+      introspection_cache_ttl: 1
+      scopes:
+        - email
+        - openid
+    locations:
+      - proxy_pass: http://127.0.0.1
+        bearer:
+          introspection: true
+          introspection_audiences:
+            - oidc-proxy-ecosystem-provider
+        headers:
+          X-Forwarded-User: sub
+        urls:
+          - path: /
+            token: "id_token"
+            type: Bearer
+    logging:
+      level: info
+      logformat: "standard"
+      timeformat: "datetime"
+    session:
+      name: "memory"
+      plugin: false
+      codecs:
+        - "something-very-secret"
+`
+
+func TestIntrospection(t *testing.T) {
+	filename := "/tmp/introspection.yaml"
+	if !assert.NoError(t, ioutil.WriteFile(filename, []byte(introspectionYAML), 0600)) {
+		return
+	}
+	defer os.Remove(filename)
+	conf, err := config.New(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	idleConnsClose := make(chan struct{})
+	resourcePort, _ := utils.FindPort()
+	server := buildServer(resourcePort)
+	l, err := net.Listen("tcp", server.Addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	go func() {
+		server.Serve(l)
+		close(idleConnsClose)
+	}()
+	idpConnsClose := make(chan struct{})
+	idp, err := framework.NewIdpServer(idpConnsClose)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	proxyPort, _ := utils.FindPort()
+	srv, err := routes.New(func() config.Servers {
+		confSrv := *conf.Servers[0]
+		confSrv.Oidc.Provider = idp.Issuer
+		confSrv.Oidc.RedirectUrl = fmt.Sprintf("http://127.0.0.1:%d/oauth2/callback", proxyPort)
+		confSrv.Locations = append([]config.Locations{}, confSrv.Locations...)
+		confSrv.Locations[0].ProxyPass = fmt.Sprintf("http://127.0.0.1:%d", resourcePort)
+		return confSrv
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxyConnsClose := make(chan struct{})
+	proxyServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", proxyPort),
+		Handler: srv,
+	}
+	proxyListen, _ := net.Listen("tcp", proxyServer.Addr)
+	go func() {
+		proxyServer.Serve(proxyListen)
+		close(proxyConnsClose)
+	}()
+	defer func() {
+		idp.Shutdown(context.Background())
+		<-idpConnsClose
+		server.Shutdown(context.Background())
+		<-idleConnsClose
+		proxyServer.Shutdown(context.Background())
+		<-proxyConnsClose
+	}()
+	proxyURL := func(url string) string {
+		return fmt.Sprintf("http://127.0.0.1:%d/%s", proxyPort, url)
+	}
+	noRedirect := func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	t.Run("opaque bearer token", func(t *testing.T) {
+		client := &http.Client{CheckRedirect: noRedirect}
+		get := func(token string) (*http.Response, string) {
+			req, _ := http.NewRequest(http.MethodGet, proxyURL("api/v1/identity"), nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			res, err := client.Do(req)
+			if !assert.NoError(t, err) {
+				return nil, ""
+			}
+			defer res.Body.Close()
+			buf, _ := ioutil.ReadAll(res.Body)
+			return res, string(buf)
+		}
+		// クレームはイントロスペクションのレスポンスから取得する
+		res, body := get(framework.OpaqueToken)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, framework.Subject+" ", body)
+
+		// 他のクライアント向けのトークンは有効であっても受け付けない
+		res, _ = get(framework.ForeignOpaqueToken)
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+		assert.Equal(t, `Bearer error="invalid_token"`, res.Header.Get("WWW-Authenticate"))
+
+		res, _ = get("unknown-token")
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+		assert.Equal(t, `Bearer error="invalid_token"`, res.Header.Get("WWW-Authenticate"))
+
+		// IdPの障害は内部のエラーを返さずに503とする
+		idp.IntrospectionStatus = http.StatusInternalServerError
+		defer func() { idp.IntrospectionStatus = 0 }()
+		res, body = get("outage-token")
+		assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+		assert.NotContains(t, body, "introspection")
+
+		// 形式が不正なトークンとしてIdPが拒否した場合は無効なトークンとして扱う
+		idp.IntrospectionStatus = http.StatusBadRequest
+		res, _ = get("malformed-token")
+		assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+		assert.Equal(t, `Bearer error="invalid_token"`, res.Header.Get("WWW-Authenticate"))
+	})
+	t.Run("revoked access token logs out the session", func(t *testing.T) {
+		client := &http.Client{
+			Transport: &mockTransport{rt: http.DefaultTransport.RoundTrip},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if req.URL.Path == "/" {
+					return http.ErrUseLastResponse
+				}
+				return nil
+			},
+		}
+		res, err := client.Get(proxyURL("oauth2/login"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+
+		get := func() *http.Response {
+			res, err := client.Get(proxyURL("api/v1/hello"))
+			if !assert.NoError(t, err) {
+				return nil
+			}
+			res.Body.Close()
+			return res
+		}
+		res = get()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		// 結果はキャッシュされ、同じトークンで再度問い合わせない
+		introspections := idp.Introspections()
+		res = get()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Equal(t, introspections, idp.Introspections())
+
+		// IdPで無効化されたトークンのセッションはログアウトしたものとして扱う
+		idp.Revoke("accesstoken")
+		time.Sleep(1100 * time.Millisecond)
+		client.CheckRedirect = noRedirect
+		res = get()
+		assert.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+		assert.Equal(t, "/oauth2/login?rd=%2Fapi%2Fv1%2Fhello", res.Header.Get("Location"))
+	})
+}
@@ -8,16 +8,23 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/e2e/framework"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/e2e/utils"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/routes"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/test/bufconn"
 )
 
 const applicationYAML = `
@@ -35,6 +42,12 @@ servers:
     login: "/oauth2/login"
     callback: "/oauth2/callback"
     logout: "/oauth2/logout"
+    post_logout: "/oauth2/logout/callback"
+    backchannel_logout: "/oauth2/backchannel_logout"
+    frontchannel_logout: "/oauth2/frontchannel_logout"
+    auth_check: "/oauth2/auth"
+    allowed_redirect_domains:
+      - .example.com
     redirect: true
     oidc:
       provider: http://127.0.0.1
@@ -42,6 +55,9 @@ servers:
       client_secret: "test"
       logout: ""
       redirect_url: http://127.0.0.1:8888/oauth2/callback
+      pkce: required
+      token_endpoint_auth_method: private_key_jwt
+      private_key: /tmp/oidc-proxy-client-key.pem
       scopes:
         - email
         - openid
@@ -49,15 +65,70 @@ servers:
         - profile
     locations:
       - proxy_pass: http://127.0.0.1, http://127.0.0.1
+        headers:
+          X-Forwarded-User: sub
+          X-Forwarded-Email: email
         urls:
           - path: /
             token: "id_token"
             type: Bearer
+          - path: /api/v1/admin
+            token: "id_token"
+            type: Bearer
+            access:
+              roles:
+                - admin
+              roles_claim: realm_access.roles
+          - path: /api/v1/payments
+            token: "id_token"
+            type: Bearer
+            acr:
+              - mfa
       - proxy_pass: http://127.0.0.1
         urls:
           - path: /ws/echo
             token: "id_token"
             type: Bearer
+      - proxy_pass: http://127.0.0.1
+        impersonation:
+          enabled: true
+          user_claim: email
+          user_prefix: "oidc:"
+          extra_claims:
+            - sid
+        urls:
+          - path: /api/v1/impersonate
+            token: "id_token"
+            type: Bearer
+      - proxy_pass: http://127.0.0.1
+        token_exchange:
+          audience: https://orders.example.com
+          scopes:
+            - orders.read
+        urls:
+          - path: /api/v1/exchange
+            token: "access_token"
+            type: Bearer
+      - proxy_pass: http://127.0.0.1
+        client_credentials:
+          client_id: oidc-proxy-machine
+          client_secret: machine-secret
+          scopes:
+            - orders.write
+        headers:
+          X-Forwarded-User: sub
+        urls:
+          - path: /api/v1/machine
+            token: "id_token"
+            type: Bearer
+      - proxy_pass: http://127.0.0.1
+        unauthenticated: auto
+        preserve_request:
+          enabled: true
+        urls:
+          - path: /api/v1/form
+            token: "id_token"
+            type: Bearer
     logging:
       level: info
       logformat: "standard"
@@ -81,6 +152,33 @@ func buildServer(port int) *http.Server {
 		log.Println(port)
 		rw.Write([]byte("hello, world"))
 	})
+	mux.HandleFunc("/api/v1/authorization", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(r.Header.Get("Authorization")))
+	})
+	mux.HandleFunc("/api/v1/form", func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rw.Write([]byte(r.Method + " " + string(body)))
+	})
+	mux.HandleFunc("/api/v1/payments", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("payments"))
+	})
+	mux.HandleFunc("/api/v1/machine", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(r.Header.Get("Authorization") + " " + r.Header.Get("X-Forwarded-User")))
+	})
+	mux.HandleFunc("/api/v1/exchange", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(r.Header.Get("Authorization")))
+	})
+	mux.HandleFunc("/api/v1/impersonate", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(strings.Join([]string{
+			r.Header.Get("Authorization"),
+			r.Header.Get("Impersonate-User"),
+			strings.Join(r.Header.Values("Impersonate-Group"), ","),
+			r.Header.Get("Impersonate-Extra-Sid"),
+		}, "|")))
+	})
+	mux.HandleFunc("/api/v1/identity", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(r.Header.Get("X-Forwarded-User") + " " + r.Header.Get("X-Forwarded-Email")))
+	})
 	s := &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
 		Handler: mux,
@@ -89,11 +187,13 @@ func buildServer(port int) *http.Server {
 }
 
 type mockTransport struct {
+	mu     sync.Mutex
 	rt     func(*http.Request) (*http.Response, error)
 	cookie map[string][]*http.Cookie
 }
 
 func (m *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m.mu.Lock()
 	if m.cookie == nil {
 		m.cookie = make(map[string][]*http.Cookie)
 	}
@@ -104,9 +204,19 @@ func (m *mockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 			}
 		}
 	}
+	m.mu.Unlock()
 	resp, err := m.rt(req)
-	if err == nil {
-		m.cookie[req.URL.Host] = resp.Cookies()
+	if err == nil && len(resp.Cookies()) > 0 {
+		// 削除されたCookieは以降のリクエストへ付与しない
+		var cookies []*http.Cookie
+		for _, cookie := range resp.Cookies() {
+			if cookie.MaxAge >= 0 {
+				cookies = append(cookies, cookie)
+			}
+		}
+		m.mu.Lock()
+		m.cookie[req.URL.Host] = cookies
+		m.mu.Unlock()
 	}
 	return resp, err
 }
@@ -187,6 +297,16 @@ func TestProxy(t *testing.T) {
 	if !assert.NoError(t, err) {
 		return
 	}
+	tokenFile := "/tmp/serviceaccount-token"
+	if !assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("serviceaccount-token\n"), 0600)) {
+		return
+	}
+	defer os.Remove(tokenFile)
+	clientKeyFile := "/tmp/oidc-proxy-client-key.pem"
+	if !assert.NoError(t, idp.RegisterClientKey(clientKeyFile)) {
+		return
+	}
+	defer os.Remove(clientKeyFile)
 	proxyPort, _ := utils.FindPort()
 	srv, err := routes.New(func() config.Servers {
 		confSrv := *conf.Servers[0]
@@ -194,6 +314,17 @@ func TestProxy(t *testing.T) {
 		confSrv.Locations[0].ProxyPass = fmt.Sprintf("http://127.0.0.1:%d,http://127.0.0.1:%d", resourcePort, resourcePort2)
 		confSrv.Locations[1].ProxyPass = fmt.Sprintf("http://127.0.0.1:%d", resourcePort3)
 		confSrv.Oidc.RedirectUrl = fmt.Sprintf("http://127.0.0.1:%d/oauth2/callback", proxyPort)
+		confSrv.Oidc.PostLogoutRedirectUrl = fmt.Sprintf("http://127.0.0.1:%d/oauth2/logout/callback", proxyPort)
+		confSrv.Locations[2].ProxyPass = fmt.Sprintf("http://127.0.0.1:%d", resourcePort)
+		confSrv.Locations[2].Impersonation.TokenFile = tokenFile
+		confSrv.Locations[3].ProxyPass = fmt.Sprintf("http://127.0.0.1:%d", resourcePort)
+		confSrv.Locations[4].ProxyPass = fmt.Sprintf("http://127.0.0.1:%d", resourcePort)
+		confSrv.Locations[5].ProxyPass = fmt.Sprintf("http://127.0.0.1:%d", resourcePort)
+		confSrv.Locations[0].Bearer = config.Bearer{
+			Issuers: []config.TrustedIssuer{
+				{Issuer: idp.Issuer, Audiences: []string{"https://api.example.com"}},
+			},
+		}
 		return confSrv
 	})
 	if !assert.NoError(t, err) {
@@ -233,17 +364,58 @@ func TestProxy(t *testing.T) {
 		name string
 		fn   func(t *testing.T)
 	}{
+		{
+			name: "authorize request with pkce",
+			fn: func(t *testing.T) {
+				client := &http.Client{
+					Transport: &mockTransport{rt: http.DefaultTransport.RoundTrip},
+					CheckRedirect: func(req *http.Request, via []*http.Request) error {
+						return http.ErrUseLastResponse
+					},
+				}
+				res, err := client.Get(proxyURL("oauth2/login"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				location, err := res.Location()
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, "S256", location.Query().Get("code_challenge_method"))
+				assert.NotEmpty(t, location.Query().Get("code_challenge"))
+			},
+		},
+		{
+			name: "replayed id token is rejected",
+			fn: func(t *testing.T) {
+				idp.ForceNonce = "replayed-nonce"
+				defer func() { idp.ForceNonce = "" }()
+				client := &http.Client{
+					Transport: &mockTransport{rt: http.DefaultTransport.RoundTrip},
+				}
+				res, err := client.Get(proxyURL("oauth2/login"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+			},
+		},
 		{
 			name: "authorize",
 			fn: func(t *testing.T) {
 				client := &http.Client{
 					Transport: mocktransport,
 				}
+				assertions := idp.ClientAssertions()
 				res, err := client.Get(proxyURL("oauth2/login"))
 				if !assert.NoError(t, err) {
 					return
 				}
 				res.Body.Close()
+				// 認可コードの交換はprivate_key_jwtで認証される
+				assert.Equal(t, assertions+1, idp.ClientAssertions())
 			},
 		},
 		{
@@ -263,6 +435,755 @@ func TestProxy(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "access rules",
+			fn: func(t *testing.T) {
+				client := &http.Client{
+					Transport: mocktransport,
+				}
+				res, err := client.Get(proxyURL("api/v1/admin"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer res.Body.Close()
+				buf, _ := ioutil.ReadAll(res.Body)
+				assert.Equal(t, http.StatusForbidden, res.StatusCode)
+				assert.JSONEq(t, `{"status_code":403,"message":"Forbidden"}`, string(buf))
+			},
+		},
+		{
+			name: "identity headers",
+			fn: func(t *testing.T) {
+				client := &http.Client{
+					Transport: mocktransport,
+				}
+				req, _ := http.NewRequest(http.MethodGet, proxyURL("api/v1/identity"), nil)
+				// クライアントが送信したヘッダーは上書きされる
+				req.Header.Set("X-Forwarded-User", "spoofed")
+				req.Header.Set("x-forwarded-email", "spoofed@example.com")
+				res, err := client.Do(req)
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer res.Body.Close()
+				buf, _ := ioutil.ReadAll(res.Body)
+				assert.Equal(t, framework.Subject+" oidc-proxy-ecosystem@n-creativesystem.dev", string(buf))
+			},
+		},
+		{
+			name: "kubernetes impersonation",
+			fn: func(t *testing.T) {
+				client := &http.Client{
+					Transport: mocktransport,
+				}
+				req, _ := http.NewRequest(http.MethodGet, proxyURL("api/v1/impersonate"), nil)
+				req.Header.Set("Impersonate-User", "system:admin")
+				req.Header.Set("Impersonate-Group", "system:masters")
+				res, err := client.Do(req)
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer res.Body.Close()
+				buf, _ := ioutil.ReadAll(res.Body)
+				values := strings.Split(string(buf), "|")
+				if !assert.Len(t, values, 4) {
+					return
+				}
+				assert.Equal(t, "Bearer serviceaccount-token", values[0])
+				assert.Equal(t, "oidc:oidc-proxy-ecosystem@n-creativesystem.dev", values[1])
+				assert.Equal(t, "", values[2])
+				assert.NotEmpty(t, values[3])
+			},
+		},
+		{
+			name: "token exchange",
+			fn: func(t *testing.T) {
+				client := &http.Client{
+					Transport: mocktransport,
+				}
+				exchanges := idp.Exchanges()
+				for i := 0; i < 2; i++ {
+					req, _ := http.NewRequest(http.MethodGet, proxyURL("api/v1/exchange"), nil)
+					res, err := client.Do(req)
+					if !assert.NoError(t, err) {
+						return
+					}
+					buf, _ := ioutil.ReadAll(res.Body)
+					res.Body.Close()
+					assert.Equal(t, "Bearer exchanged-https://orders.example.com", string(buf))
+				}
+				// 交換したトークンはセッションにキャッシュされる
+				assert.Equal(t, exchanges+1, idp.Exchanges())
+			},
+		},
+		{
+			name: "client credentials",
+			fn: func(t *testing.T) {
+				client := &http.Client{
+					Transport: mocktransport,
+				}
+				grants := idp.ClientCredentialsGrants()
+				for i := 0; i < 2; i++ {
+					req, _ := http.NewRequest(http.MethodGet, proxyURL("api/v1/machine"), nil)
+					res, err := client.Do(req)
+					if !assert.NoError(t, err) {
+						return
+					}
+					buf, _ := ioutil.ReadAll(res.Body)
+					res.Body.Close()
+					assert.Equal(t, "Bearer machine-oidc-proxy-machine "+framework.Subject, string(buf))
+				}
+				// トークンは有効期限まで共有される
+				assert.Equal(t, grants+1, idp.ClientCredentialsGrants())
+			},
+		},
+		{
+			name: "forward auth",
+			fn: func(t *testing.T) {
+				var visited []string
+				client := &http.Client{
+					Transport: &mockTransport{rt: http.DefaultTransport.RoundTrip},
+					CheckRedirect: func(req *http.Request, via []*http.Request) error {
+						visited = append(visited, req.URL.String())
+						if req.URL.Host != fmt.Sprintf("127.0.0.1:%d", proxyPort) && !strings.HasPrefix(req.URL.String(), idp.Issuer) {
+							return http.ErrUseLastResponse
+						}
+						return nil
+					},
+				}
+				authCheck := func() *http.Response {
+					req, _ := http.NewRequest(http.MethodGet, proxyURL("oauth2/auth"), nil)
+					req.Header.Set("X-Forwarded-Proto", "https")
+					req.Header.Set("X-Forwarded-Host", "app.example.com")
+					req.Header.Set("X-Forwarded-Uri", "/dashboard?tab=1")
+					res, err := client.Do(req)
+					if !assert.NoError(t, err) {
+						return nil
+					}
+					res.Body.Close()
+					return res
+				}
+				res := authCheck()
+				assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+				login := res.Header.Get("Location")
+				assert.Equal(t, "/oauth2/login?rd="+url.QueryEscape("https://app.example.com/dashboard?tab=1"), login)
+
+				// 許可されたドメインへの戻り先はログイン後にリダイレクトされる
+				res, err := client.Get(proxyURL(login[1:]))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				assert.Equal(t, "https://app.example.com/dashboard?tab=1", visited[len(visited)-1])
+
+				res = authCheck()
+				assert.Equal(t, http.StatusOK, res.StatusCode)
+				assert.Equal(t, framework.Subject, res.Header.Get("X-Auth-Request-User"))
+				assert.Equal(t, "oidc-proxy-ecosystem@n-creativesystem.dev", res.Header.Get("X-Auth-Request-Email"))
+
+				// 許可されていない戻り先は無視される
+				res, err = client.Get(proxyURL("oauth2/login?rd=" + url.QueryEscape("//evil.com/")))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				assert.NotContains(t, visited[len(visited)-1], "evil.com")
+			},
+		},
+		{
+			name: "envoy ext_authz",
+			fn: func(t *testing.T) {
+				listener := bufconn.Listen(1024 * 1024)
+				grpcServer := grpc.NewServer()
+				routes.NewExtAuthzServer(&routes.MultiHost{"app.local:80": srv}).Register(grpcServer)
+				go grpcServer.Serve(listener)
+				defer grpcServer.Stop()
+				conn, err := grpc.DialContext(context.Background(), "bufnet",
+					grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+						return listener.Dial()
+					}),
+					grpc.WithInsecure(),
+				)
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer conn.Close()
+				client := authv3.NewAuthorizationClient(conn)
+				check := func(path string, headers map[string]string) *authv3.CheckResponse {
+					res, err := client.Check(context.Background(), &authv3.CheckRequest{
+						Attributes: &authv3.AttributeContext{
+							Request: &authv3.AttributeContext_Request{
+								Http: &authv3.AttributeContext_HttpRequest{
+									Method:  http.MethodGet,
+									Scheme:  "http",
+									Host:    "app.local",
+									Path:    path,
+									Headers: headers,
+								},
+							},
+						},
+					})
+					assert.NoError(t, err)
+					return res
+				}
+				res := check("/api/v1/hello?x=1", nil)
+				denied := res.GetDeniedResponse()
+				if !assert.NotNil(t, denied) {
+					return
+				}
+				assert.Equal(t, int32(codes.PermissionDenied), res.GetStatus().GetCode())
+				assert.Equal(t, http.StatusTemporaryRedirect, int(denied.GetStatus().GetCode()))
+
+				var cookies []string
+				mocktransport.mu.Lock()
+				for _, cookie := range mocktransport.cookie[fmt.Sprintf("127.0.0.1:%d", proxyPort)] {
+					cookies = append(cookies, cookie.Name+"="+cookie.Value)
+				}
+				mocktransport.mu.Unlock()
+				res = check("/api/v1/hello?x=1", map[string]string{"cookie": strings.Join(cookies, "; ")})
+				ok := res.GetOkResponse()
+				if !assert.NotNil(t, ok) {
+					return
+				}
+				headers := map[string]string{}
+				for _, header := range ok.GetHeaders() {
+					headers[header.GetHeader().GetKey()] = header.GetHeader().GetValue()
+				}
+				assert.Contains(t, headers["Authorization"], "Bearer ")
+				assert.Equal(t, framework.Subject, headers["X-Forwarded-User"])
+
+				// ログインやログアウトは未認証でもプロキシへ転送させる
+				for _, path := range []string{"/oauth2/login?rd=%2Fapi%2Fv1%2Fhello", "/oauth2/callback?code=x&state=y", "/oauth2/logout", "/oauth2/logout/callback", "/oauth2/backchannel_logout", "/oauth2/frontchannel_logout", "/oauth2/auth"} {
+					res = check(path, nil)
+					if assert.NotNil(t, res.GetOkResponse(), path) {
+						assert.Empty(t, res.GetOkResponse().GetHeaders(), path)
+					}
+				}
+				// プロキシ自身のエンドポイントと前方一致するだけのパスは認証する
+				for _, path := range []string{"/oauth2/loginx", "/oauth2/logout/other"} {
+					res = check(path, nil)
+					assert.NotNil(t, res.GetDeniedResponse(), path)
+				}
+			},
+		},
+		{
+			name: "refresh access token before expiry",
+			fn: func(t *testing.T) {
+				idp.ExpiresIn = 30
+				defer func() { idp.ExpiresIn = 0 }()
+				client := &http.Client{
+					Transport: &mockTransport{rt: http.DefaultTransport.RoundTrip},
+					CheckRedirect: func(req *http.Request, via []*http.Request) error {
+						// コールバック後のリダイレクトには従わない
+						if req.URL.Path == "/" {
+							return http.ErrUseLastResponse
+						}
+						return nil
+					},
+				}
+				refreshes := idp.Refreshes()
+				res, err := client.Get(proxyURL("oauth2/login"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				// 同時に有効期限間近のセッションでアクセスしても更新は1回のみ
+				var wg sync.WaitGroup
+				for i := 0; i < 10; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						res, err := client.Get(proxyURL("/api/v1/hello"))
+						if !assert.NoError(t, err) {
+							return
+						}
+						buf, _ := ioutil.ReadAll(res.Body)
+						res.Body.Close()
+						assert.Equal(t, "hello, world", string(buf))
+					}()
+				}
+				wg.Wait()
+				assert.Equal(t, refreshes+1, idp.Refreshes())
+			},
+		},
+		{
+			name: "re-login when id token expired without reissue",
+			fn: func(t *testing.T) {
+				idp.IDTokenExpiresIn = 1
+				defer func() { idp.IDTokenExpiresIn = 0 }()
+				client := &http.Client{
+					Transport: &mockTransport{rt: http.DefaultTransport.RoundTrip},
+					CheckRedirect: func(req *http.Request, via []*http.Request) error {
+						if req.URL.Path == "/" {
+							return http.ErrUseLastResponse
+						}
+						return nil
+					},
+				}
+				res, err := client.Get(proxyURL("oauth2/login"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				time.Sleep(2 * time.Second)
+				client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+					return http.ErrUseLastResponse
+				}
+				// 更新でIDトークンが再発行されないため、期限切れのIDトークンは転送せずに再ログインを求める
+				refreshes := idp.Refreshes()
+				for i := 0; i < 2; i++ {
+					res, err = client.Get(proxyURL("api/v1/hello"))
+					if !assert.NoError(t, err) {
+						return
+					}
+					res.Body.Close()
+					assert.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+					assert.Equal(t, "/oauth2/login?rd=%2Fapi%2Fv1%2Fhello", res.Header.Get("Location"))
+				}
+				// アクセストークンは有効なため、再発行されないIDトークンのために更新を繰り返さない
+				assert.Equal(t, refreshes+1, idp.Refreshes())
+			},
+		},
+		{
+			name: "step-up authentication",
+			fn: func(t *testing.T) {
+				login := func() *http.Client {
+					client := &http.Client{
+						Transport: &mockTransport{rt: http.DefaultTransport.RoundTrip},
+						CheckRedirect: func(req *http.Request, via []*http.Request) error {
+							if req.URL.Path == "/" {
+								return http.ErrUseLastResponse
+							}
+							return nil
+						},
+					}
+					res, err := client.Get(proxyURL("oauth2/login"))
+					if assert.NoError(t, err) {
+						res.Body.Close()
+					}
+					return client
+				}
+				client := login()
+				followRedirect := client.CheckRedirect
+				client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+					return http.ErrUseLastResponse
+				}
+				res, err := client.Get(proxyURL("api/v1/payments"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				assert.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+				assert.Equal(t, "/oauth2/login?acr_values=mfa&rd=%2Fapi%2Fv1%2Fpayments", res.Header.Get("Location"))
+
+				// 再認証後は元のURLへ戻る
+				client.CheckRedirect = followRedirect
+				res, err = client.Get(proxyURL("api/v1/payments"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				buf, _ := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				assert.Equal(t, "payments", string(buf))
+
+				// IdPが要求を満たさないトークンを発行した場合はリダイレクトを繰り返さない
+				idp.IgnoreAcrValues = true
+				defer func() { idp.IgnoreAcrValues = false }()
+				client = login()
+				res, err = client.Get(proxyURL("api/v1/payments"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				assert.Equal(t, http.StatusForbidden, res.StatusCode)
+				assert.Equal(t, "/oauth2/callback", res.Request.URL.Path)
+			},
+		},
+		{
+			name: "concurrent logins",
+			fn: func(t *testing.T) {
+				transport := &mockTransport{rt: http.DefaultTransport.RoundTrip}
+				client := &http.Client{
+					Transport: transport,
+					CheckRedirect: func(req *http.Request, via []*http.Request) error {
+						return http.ErrUseLastResponse
+					},
+				}
+				authorize := func(rd string) string {
+					res, err := client.Get(proxyURL("oauth2/login?" + url.Values{"rd": {rd}}.Encode()))
+					if !assert.NoError(t, err) {
+						return ""
+					}
+					res.Body.Close()
+					return res.Header.Get("Location")
+				}
+				// 許可されていないドメインへは戻らない(セッションのCookieもここで発行される)
+				evil := authorize("https://evil.example.org/")
+				// セッション毎に保持する認可リクエストの上限(10)を超えない数
+				const maxTabs = 9
+				// 複数のタブで同時にログインを開始しても、それぞれのコールバックで元のURLへ戻る
+				var paths []string
+				for i := 0; i < maxTabs; i++ {
+					paths = append(paths, fmt.Sprintf("/api/v1/hello?tab=%d", i))
+				}
+				authorizeURLs := make([]string, len(paths))
+				var wg sync.WaitGroup
+				for i, path := range paths {
+					wg.Add(1)
+					go func(i int, path string) {
+						defer wg.Done()
+						authorizeURLs[i] = authorize(path)
+					}(i, path)
+				}
+				wg.Wait()
+				follow := &http.Client{Transport: transport}
+				callback := func(authorizeURL, path string) {
+					res, err := follow.Get(authorizeURL)
+					if !assert.NoError(t, err) {
+						return
+					}
+					res.Body.Close()
+					assert.Equal(t, fmt.Sprintf("127.0.0.1:%d", proxyPort), res.Request.URL.Host)
+					assert.Equal(t, path, res.Request.URL.RequestURI())
+				}
+				for i, path := range paths {
+					wg.Add(1)
+					go func(i int, path string) {
+						defer wg.Done()
+						callback(authorizeURLs[i], path)
+					}(i, path)
+				}
+				wg.Wait()
+				callback(evil, "/")
+			},
+		},
+		{
+			name: "preserve form post across login",
+			fn: func(t *testing.T) {
+				transport := &mockTransport{rt: http.DefaultTransport.RoundTrip}
+				client := &http.Client{
+					Transport: transport,
+					CheckRedirect: func(req *http.Request, via []*http.Request) error {
+						return http.ErrUseLastResponse
+					},
+				}
+				form := "comment=hello+world&tag=b&tag=a"
+				post := func(site string) *http.Response {
+					req, _ := http.NewRequest(http.MethodPost, proxyURL("api/v1/form"), strings.NewReader(form))
+					req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+					req.Header.Set("Sec-Fetch-Site", site)
+					res, err := client.Do(req)
+					if !assert.NoError(t, err) {
+						return nil
+					}
+					res.Body.Close()
+					return res
+				}
+				// 他のサイトから送信されたフォームは保存しない
+				res := post("cross-site")
+				assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+
+				res = post("same-origin")
+				// ブラウザがログインURLへPOSTを再送しないよう303とする
+				assert.Equal(t, http.StatusSeeOther, res.StatusCode)
+				location, err := res.Location()
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, "/api/v1/form", location.Query().Get("rd"))
+				assert.NotEmpty(t, location.Query().Get("rq"))
+
+				// コールバック後は中断したフォームを再送する確認ページを返す
+				follow := &http.Client{Transport: transport}
+				res, err = follow.Get(location.String())
+				if !assert.NoError(t, err) {
+					return
+				}
+				buf, _ := ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				assert.Equal(t, "/oauth2/callback", res.Request.URL.Path)
+				assert.Contains(t, string(buf), `<form method="POST" action="/api/v1/form" enctype="application/x-www-form-urlencoded">
+<input type="hidden" name="comment" value="hello world">
+<input type="hidden" name="tag" value="b">
+<input type="hidden" name="tag" value="a">`)
+				assert.NotContains(t, string(buf), "onload")
+
+				res, err = follow.Post(proxyURL("api/v1/form"), "application/x-www-form-urlencoded", strings.NewReader(form))
+				if !assert.NoError(t, err) {
+					return
+				}
+				buf, _ = ioutil.ReadAll(res.Body)
+				res.Body.Close()
+				assert.Equal(t, "POST "+form, string(buf))
+			},
+		},
+		{
+			name: "unauthenticated response depends on request type",
+			fn: func(t *testing.T) {
+				client := &http.Client{
+					CheckRedirect: func(req *http.Request, via []*http.Request) error {
+						return http.ErrUseLastResponse
+					},
+				}
+				do := func(method string, header map[string]string) *http.Response {
+					req, _ := http.NewRequest(method, proxyURL("api/v1/form"), nil)
+					for key, value := range header {
+						req.Header.Set(key, value)
+					}
+					res, err := client.Do(req)
+					if !assert.NoError(t, err) {
+						return nil
+					}
+					res.Body.Close()
+					return res
+				}
+				// ブラウザの画面遷移はログインURLへリダイレクトする
+				res := do(http.MethodGet, map[string]string{"Accept": "text/html,application/xhtml+xml,application/json;q=0.9"})
+				assert.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+				assert.Equal(t, "/oauth2/login?rd=%2Fapi%2Fv1%2Fform", res.Header.Get("Location"))
+
+				for name, req := range map[string]struct {
+					method string
+					header map[string]string
+				}{
+					"xhr":    {http.MethodGet, map[string]string{"X-Requested-With": "XMLHttpRequest"}},
+					"fetch":  {http.MethodGet, map[string]string{"Sec-Fetch-Mode": "cors"}},
+					"json":   {http.MethodGet, map[string]string{"Accept": "application/json"}},
+					"delete": {http.MethodDelete, nil},
+				} {
+					res := do(req.method, req.header)
+					assert.Equal(t, http.StatusUnauthorized, res.StatusCode, name)
+					assert.Equal(t, `Bearer realm="127.0.0.1"`, res.Header.Get("WWW-Authenticate"), name)
+					assert.Equal(t, "application/json", res.Header.Get("Content-Type"), name)
+					assert.Equal(t, "/oauth2/login?rd=%2Fapi%2Fv1%2Fform", res.Header.Get("Location"), name)
+				}
+			},
+		},
+		{
+			name: "rp-initiated logout",
+			fn: func(t *testing.T) {
+				var visited []string
+				client := &http.Client{
+					Transport: &mockTransport{rt: http.DefaultTransport.RoundTrip},
+					CheckRedirect: func(req *http.Request, via []*http.Request) error {
+						visited = append(visited, req.URL.Path)
+						if req.URL.Path == "/" {
+							return http.ErrUseLastResponse
+						}
+						return nil
+					},
+				}
+				res, err := client.Get(proxyURL("oauth2/login"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				visited = nil
+				res, err = client.Get(proxyURL("oauth2/logout"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				assert.Equal(t, []string{"/v2/logout", "/oauth2/logout/callback", "/"}, visited)
+				// ログアウト後はログインへリダイレクトされる
+				client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+					return http.ErrUseLastResponse
+				}
+				res, err = client.Get(proxyURL("api/v1/hello"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				assert.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+				assert.Equal(t, "/oauth2/login?rd=%2Fapi%2Fv1%2Fhello", res.Header.Get("Location"))
+			},
+		},
+		{
+			name: "back-channel logout",
+			fn: func(t *testing.T) {
+				login := func() *http.Client {
+					client := &http.Client{
+						Transport: &mockTransport{rt: http.DefaultTransport.RoundTrip},
+						CheckRedirect: func(req *http.Request, via []*http.Request) error {
+							if req.URL.Path == "/" || req.URL.Path == "/oauth2/login" {
+								return http.ErrUseLastResponse
+							}
+							return nil
+						},
+					}
+					res, err := client.Get(proxyURL("oauth2/login"))
+					if assert.NoError(t, err) {
+						res.Body.Close()
+					}
+					return client
+				}
+				status := func(client *http.Client) int {
+					res, err := client.Get(proxyURL("api/v1/hello"))
+					if !assert.NoError(t, err) {
+						return 0
+					}
+					res.Body.Close()
+					return res.StatusCode
+				}
+				backchannel := func(logoutToken string) int {
+					res, err := http.PostForm(proxyURL("oauth2/backchannel_logout"), url.Values{"logout_token": {logoutToken}})
+					if !assert.NoError(t, err) {
+						return 0
+					}
+					res.Body.Close()
+					return res.StatusCode
+				}
+				first := login()
+				firstSid := idp.LastSessionID()
+				second := login()
+				assert.Equal(t, http.StatusOK, status(first))
+				assert.Equal(t, http.StatusOK, status(second))
+
+				// 署名が不正なログアウトトークンは拒否される
+				invalidToken, _ := idp.LogoutToken(framework.Subject, firstSid)
+				assert.Equal(t, http.StatusBadRequest, backchannel(invalidToken[:len(invalidToken)-2]))
+
+				// sidを指定した場合は該当するセッションのみ削除される
+				logoutToken, err := idp.LogoutToken(framework.Subject, firstSid)
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, http.StatusOK, backchannel(logoutToken))
+				assert.Equal(t, http.StatusTemporaryRedirect, status(first))
+				assert.Equal(t, http.StatusOK, status(second))
+
+				// 同じjtiのログアウトトークンの再送は拒否される
+				assert.Equal(t, http.StatusBadRequest, backchannel(logoutToken))
+
+				// subのみの場合は全てのセッションが削除される
+				logoutToken, err = idp.LogoutToken(framework.Subject, "")
+				if !assert.NoError(t, err) {
+					return
+				}
+				assert.Equal(t, http.StatusOK, backchannel(logoutToken))
+				assert.Equal(t, http.StatusTemporaryRedirect, status(second))
+			},
+		},
+		{
+			name: "front-channel logout",
+			fn: func(t *testing.T) {
+				client := &http.Client{
+					Transport: &mockTransport{rt: http.DefaultTransport.RoundTrip},
+					CheckRedirect: func(req *http.Request, via []*http.Request) error {
+						if req.URL.Path == "/" || req.URL.Path == "/oauth2/login" {
+							return http.ErrUseLastResponse
+						}
+						return nil
+					},
+				}
+				res, err := client.Get(proxyURL("oauth2/login"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				sid := idp.LastSessionID()
+				q := url.Values{"iss": {"http://example.com"}, "sid": {sid}}
+				res, err = client.Get(proxyURL("oauth2/frontchannel_logout?" + q.Encode()))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+				// sidを指定する場合はissが必須
+				res, err = client.Get(proxyURL("oauth2/frontchannel_logout?" + url.Values{"sid": {sid}}.Encode()))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+				// ブラウザのセッション以外はsidを知っていてもログアウトできない
+				q.Set("iss", idp.Issuer)
+				res, err = http.Get(proxyURL("oauth2/frontchannel_logout?" + q.Encode()))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				assert.Equal(t, http.StatusOK, res.StatusCode)
+				res, err = client.Get(proxyURL("api/v1/hello"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				assert.Equal(t, http.StatusOK, res.StatusCode)
+
+				res, err = client.Get(proxyURL("oauth2/frontchannel_logout?" + q.Encode()))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				assert.Equal(t, http.StatusOK, res.StatusCode)
+				assert.Equal(t, "no-cache, no-store", res.Header.Get("Cache-Control"))
+				res, err = client.Get(proxyURL("api/v1/hello"))
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				assert.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+			},
+		},
+		{
+			name: "bearer token from api client",
+			fn: func(t *testing.T) {
+				client := &http.Client{
+					CheckRedirect: func(req *http.Request, via []*http.Request) error {
+						return http.ErrUseLastResponse
+					},
+				}
+				get := func(token string) (*http.Response, string) {
+					req, _ := http.NewRequest(http.MethodGet, proxyURL("api/v1/authorization"), nil)
+					if token != "" {
+						req.Header.Set("Authorization", "Bearer "+token)
+					}
+					res, err := client.Do(req)
+					if !assert.NoError(t, err) {
+						return nil, ""
+					}
+					defer res.Body.Close()
+					buf, _ := ioutil.ReadAll(res.Body)
+					return res, string(buf)
+				}
+				token, err := idp.AccessToken("https://api.example.com")
+				if !assert.NoError(t, err) {
+					return
+				}
+				res, body := get(token)
+				assert.Equal(t, http.StatusOK, res.StatusCode)
+				assert.Equal(t, "Bearer "+token, body)
+
+				// 同じロケーションのパスは鍵のキャッシュを共有し、JWKSを再取得しない
+				jwksRequests := idp.JWKSRequests()
+				req, _ := http.NewRequest(http.MethodGet, proxyURL("api/v1/admin"), nil)
+				req.Header.Set("Authorization", "Bearer "+token)
+				res, err = client.Do(req)
+				if !assert.NoError(t, err) {
+					return
+				}
+				res.Body.Close()
+				assert.NotEqual(t, http.StatusUnauthorized, res.StatusCode)
+				assert.Equal(t, jwksRequests, idp.JWKSRequests())
+
+				// audienceが信頼されていないトークンはログインへリダイレクトせず401とする
+				token, err = idp.AccessToken("https://other.example.com")
+				if !assert.NoError(t, err) {
+					return
+				}
+				res, _ = get(token)
+				assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+				assert.Equal(t, `Bearer error="invalid_token"`, res.Header.Get("WWW-Authenticate"))
+
+				// ベアラートークンが無い場合はこれまで通りCookieのセッションを使用する
+				res, _ = get("")
+				assert.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+				assert.Equal(t, "/oauth2/login?rd=%2Fapi%2Fv1%2Fauthorization", res.Header.Get("Location"))
+			},
+		},
 		{
 			name: "websocket proxy",
 			fn: func(t *testing.T) {
@@ -0,0 +1,364 @@
+package scenario_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/e2e/framework"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/e2e/utils"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/routes"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2/jws"
+)
+
+const providersYAML = `
+servers:
+  - server_name: providers
+    port: 8080
+    cookie_name: session
+    login: "/oauth2/login"
+    callback: "/oauth2/callback"
+    logout: "/oauth2/logout"
+    frontchannel_logout: "/oauth2/frontchannel_logout"
+    redirect: true
+    oidc:
+      provider: http://127.0.0.1
+      client_id: "oidc-proxy-ecosystem-provider"
+      client_secret: "test"
+      scopes:
+        - email
+        - openid
+    providers:
+      - name: offline
+        display_name: Offline
+        oidc:
+          provider: http://127.0.0.1:1
+          client_id: "oidc-proxy-ecosystem-provider"
+          client_secret: "test"
+          scopes:
+            - openid
+      - name: contractors
+        display_name: Contractors
+        domains:
+          - contractor.example.com
+        oidc:
+          provider: http://127.0.0.1
+          client_id: "oidc-proxy-ecosystem-provider"
+          client_secret: "test"
+          scopes:
+            - email
+            - openid
+      - name: github
+        display_name: GitHub
+        oidc:
+          type: oauth2
+          authorize_url: http://127.0.0.1/authorize
+          token_url: http://127.0.0.1/oauth/token
+          userinfo_url: http://127.0.0.1/user
+          subject_claim: id
+          default_token_lifetime: 1
+          client_id: "oidc-proxy-ecosystem-provider"
+          client_secret: "test"
+          scopes:
+            - read:user
+    locations:
+      - proxy_pass: http://127.0.0.1
+        headers:
+          X-Forwarded-User: sub
+          X-Forwarded-Email: email
+        urls:
+          - path: /
+            token: "id_token"
+            type: Bearer
+      - proxy_pass: http://127.0.0.1
+        client_credentials:
+          client_id: oidc-proxy-machine
+          client_secret: machine-secret
+          provider: contractors
+        urls:
+          - path: /api/v1/machine
+            token: "id_token"
+            type: Bearer
+    logging:
+      level: info
+      logformat: "standard"
+      timeformat: "datetime"
+    session:
+      name: "memory"
+      plugin: false
+      codecs:
+        - "something-very-secret"
+`
+
+func TestMultipleProviders(t *testing.T) {
+	filename := "/tmp/providers.yaml"
+	if !assert.NoError(t, ioutil.WriteFile(filename, []byte(providersYAML), 0600)) {
+		return
+	}
+	defer os.Remove(filename)
+	conf, err := config.New(filename)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	idleConnsClose := make(chan struct{})
+	resourcePort, _ := utils.FindPort()
+	server := buildServer(resourcePort)
+	l, err := net.Listen("tcp", server.Addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	go func() {
+		server.Serve(l)
+		close(idleConnsClose)
+	}()
+	employeesClose := make(chan struct{})
+	employees, err := framework.NewIdpServer(employeesClose)
+	if !assert.NoError(t, err) {
+		return
+	}
+	contractorsClose := make(chan struct{})
+	contractors, err := framework.NewIdpServer(contractorsClose)
+	if !assert.NoError(t, err) {
+		return
+	}
+	githubClose := make(chan struct{})
+	github, err := framework.NewIdpServer(githubClose)
+	if !assert.NoError(t, err) {
+		return
+	}
+	github.OmitIDToken = true
+	github.OmitRefreshToken = true
+
+	proxyPort, _ := utils.FindPort()
+	srv, err := routes.New(func() config.Servers {
+		confSrv := *conf.Servers[0]
+		redirectURL := fmt.Sprintf("http://127.0.0.1:%d/oauth2/callback", proxyPort)
+		confSrv.Oidc.Provider = employees.Issuer
+		confSrv.Oidc.RedirectUrl = redirectURL
+		confSrv.Providers = append([]config.Provider{}, confSrv.Providers...)
+		confSrv.Providers[1].Oidc.Provider = contractors.Issuer
+		confSrv.Providers[1].Oidc.RedirectUrl = redirectURL
+		confSrv.Providers[2].Oidc.AuthorizeUrl = github.Issuer + "/authorize"
+		confSrv.Providers[2].Oidc.TokenUrl = github.Issuer + "/oauth/token"
+		confSrv.Providers[2].Oidc.UserinfoUrl = github.Issuer + "/user"
+		confSrv.Providers[2].Oidc.RedirectUrl = redirectURL
+		confSrv.Locations = append([]config.Locations{}, confSrv.Locations...)
+		confSrv.Locations[0].ProxyPass = fmt.Sprintf("http://127.0.0.1:%d", resourcePort)
+		confSrv.Locations[1].ProxyPass = fmt.Sprintf("http://127.0.0.1:%d", resourcePort)
+		return confSrv
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	proxyConnsClose := make(chan struct{})
+	proxyServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", proxyPort),
+		Handler: srv,
+	}
+	proxyListen, _ := net.Listen("tcp", proxyServer.Addr)
+	go func() {
+		proxyServer.Serve(proxyListen)
+		close(proxyConnsClose)
+	}()
+	defer func() {
+		employees.Shutdown(context.Background())
+		<-employeesClose
+		contractors.Shutdown(context.Background())
+		<-contractorsClose
+		github.Shutdown(context.Background())
+		<-githubClose
+		server.Shutdown(context.Background())
+		<-idleConnsClose
+		proxyServer.Shutdown(context.Background())
+		<-proxyConnsClose
+	}()
+	proxyURL := func(url string) string {
+		return fmt.Sprintf("http://127.0.0.1:%d/%s", proxyPort, url)
+	}
+	noRedirect := func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	t.Run("provider chooser", func(t *testing.T) {
+		client := &http.Client{CheckRedirect: noRedirect}
+		res, err := client.Get(proxyURL("oauth2/login?rd=https://app.example.com/"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer res.Body.Close()
+		buf, _ := ioutil.ReadAll(res.Body)
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		assert.Contains(t, string(buf), "provider=default")
+		assert.Contains(t, string(buf), "provider=contractors")
+		assert.Contains(t, string(buf), ">Contractors<")
+	})
+	t.Run("login hint selects provider", func(t *testing.T) {
+		client := &http.Client{CheckRedirect: noRedirect}
+		res, err := client.Get(proxyURL("oauth2/login?login_hint=bob@contractor.example.com"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+		location, err := res.Location()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, strings.HasPrefix(location.String(), contractors.Issuer+"/authorize"))
+		assert.Equal(t, "bob@contractor.example.com", location.Query().Get("login_hint"))
+	})
+	t.Run("unknown provider", func(t *testing.T) {
+		client := &http.Client{CheckRedirect: noRedirect}
+		res, err := client.Get(proxyURL("oauth2/login?provider=unknown"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+	})
+	t.Run("front-channel logout skips unavailable provider", func(t *testing.T) {
+		client := &http.Client{Transport: &mockTransport{rt: http.DefaultTransport.RoundTrip}}
+		res, err := client.Get(proxyURL("oauth2/login?provider=contractors"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+
+		// ディスカバリ情報を取得できないIdPがあっても、他のIdPからのログアウト通知は処理する
+		client.CheckRedirect = noRedirect
+		res, err = client.Get(proxyURL("oauth2/frontchannel_logout?" + url.Values{"iss": {contractors.Issuer}}.Encode()))
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+		res, err = client.Get(proxyURL("api/v1/authorization"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+	})
+	t.Run("session uses the issuing provider", func(t *testing.T) {
+		transport := &mockTransport{rt: http.DefaultTransport.RoundTrip}
+		client := &http.Client{Transport: transport}
+		res, err := client.Get(proxyURL("oauth2/login?provider=contractors"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+
+		res, err = client.Get(proxyURL("api/v1/authorization"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		claims, err := jws.Decode(strings.TrimPrefix(string(buf), "Bearer "))
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, contractors.Issuer, claims.Iss)
+
+		// ログアウトはトークンを発行したIdPへ遷移する
+		client.CheckRedirect = noRedirect
+		res, err = client.Get(proxyURL("oauth2/logout"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+		location, err := res.Location()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.True(t, strings.HasPrefix(location.String(), contractors.Issuer+"/v2/logout"))
+	})
+	t.Run("client credentials from the configured provider", func(t *testing.T) {
+		client := &http.Client{Transport: &mockTransport{rt: http.DefaultTransport.RoundTrip}}
+		res, err := client.Get(proxyURL("oauth2/login?provider=default"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+
+		res, err = client.Get(proxyURL("api/v1/machine"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, "Bearer machine-oidc-proxy-machine", strings.TrimSpace(string(buf)))
+		// ログインしたIdPに関わらずproviderのトークンエンドポイントから取得する
+		assert.Equal(t, 1, contractors.ClientCredentialsGrants())
+		assert.Equal(t, 0, employees.ClientCredentialsGrants())
+	})
+	t.Run("oauth2 provider without id token", func(t *testing.T) {
+		transport := &mockTransport{rt: http.DefaultTransport.RoundTrip}
+		client := &http.Client{Transport: transport}
+		res, err := client.Get(proxyURL("oauth2/login?provider=github"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+
+		// IDトークンの代わりにアクセストークンを転送する
+		res, err = client.Get(proxyURL("api/v1/authorization"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		buf, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, "Bearer accesstoken", string(buf))
+
+		// ユーザー情報のクレームはセッションにキャッシュされる
+		res, err = client.Get(proxyURL("api/v1/identity"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		buf, _ = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		assert.Equal(t, "583231 octocat@github.example.com", string(buf))
+
+		client.CheckRedirect = noRedirect
+		res, err = client.Get(proxyURL("oauth2/logout"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Equal(t, "/", res.Header.Get("Location"))
+	})
+	t.Run("oauth2 provider revalidates non-expiring token", func(t *testing.T) {
+		transport := &mockTransport{rt: http.DefaultTransport.RoundTrip}
+		client := &http.Client{Transport: transport}
+		res, err := client.Get(proxyURL("oauth2/login?provider=github"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+
+		client.CheckRedirect = noRedirect
+		res, err = client.Get(proxyURL("api/v1/authorization"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+
+		// 有効期限のないトークンはユーザー情報エンドポイントで再検証し、取り消された場合は再ログインを求める
+		github.Revoke("accesstoken")
+		res, err = client.Get(proxyURL("api/v1/authorization"))
+		if !assert.NoError(t, err) {
+			return
+		}
+		res.Body.Close()
+		assert.Equal(t, http.StatusTemporaryRedirect, res.StatusCode)
+	})
+}
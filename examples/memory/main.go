@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -44,12 +46,14 @@ func (i *item) Expired(time int64) bool {
 
 type memorySession struct {
 	items  map[string]*item
+	locks  map[string]*item
 	mu     sync.Mutex
 	prefix string
 	ttl    int
 }
 
 var _ session.Session = &memorySession{}
+var _ session.Locker = &memorySession{}
 
 func (c *memorySession) Get(ctx context.Context, originalKey string) (string, error) {
 	c.mu.Lock()
@@ -79,6 +83,33 @@ func (c *memorySession) Delete(ctx context.Context, key string) error {
 	delete(c.items, key)
 	return nil
 }
+func (c *memorySession) TryLock(ctx context.Context, key string, ttl time.Duration) (string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key = path.Join(c.prefix, key)
+	now := time.Now()
+	if v, ok := c.locks[key]; ok && !v.Expired(now.UnixNano()) {
+		return "", false, nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", false, err
+	}
+	token := hex.EncodeToString(b)
+	c.locks[key] = newItem(token, now.Add(ttl).UnixNano())
+	log.Debug(fmt.Sprintf("[LOCK] %s:%s", key, token))
+	return token, true, nil
+}
+func (c *memorySession) Unlock(ctx context.Context, key string, token string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key = path.Join(c.prefix, key)
+	if v, ok := c.locks[key]; ok && v.Value == token {
+		log.Debug(fmt.Sprintf("[UNLOCK] %s:%s", key, token))
+		delete(c.locks, key)
+	}
+	return nil
+}
 func (c *memorySession) Close(ctx context.Context) error {
 	if file != nil {
 		log.Debug("close method: file close")
@@ -121,6 +152,7 @@ func (c *memorySession) Init(ctx context.Context, setting map[string]interface{}
 func newMemorySession() *memorySession {
 	c := &memorySession{
 		items:  make(map[string]*item),
+		locks:  make(map[string]*item),
 		mu:     sync.Mutex{},
 		prefix: "memory",
 		ttl:    90,
@@ -137,6 +169,11 @@ func newMemorySession() *memorySession {
 						delete(c.items, k)
 					}
 				}
+				for k, v := range c.locks {
+					if v.Expired(time.Now().UnixNano()) {
+						delete(c.locks, k)
+					}
+				}
 				c.mu.Unlock()
 			}
 		}
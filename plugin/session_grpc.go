@@ -3,11 +3,14 @@ package plugin
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/hashicorp/go-plugin"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/internal/proto"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/session"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type GRPCSessionServer struct {
@@ -41,6 +44,25 @@ func (c *GRPCSessionServer) Close(ctx context.Context, e *proto.Empty) (*proto.E
 	err := c.Impl.Close(ctx)
 	return &proto.Empty{}, err
 }
+func (c *GRPCSessionServer) TryLock(ctx context.Context, r *proto.LockRequest) (*proto.LockResponse, error) {
+	locker, ok := c.Impl.(session.Locker)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, session.ErrLockNotSupported.Error())
+	}
+	token, locked, err := locker.TryLock(ctx, r.Key, time.Duration(r.Ttl)*time.Millisecond)
+	return &proto.LockResponse{
+		Locked: locked,
+		Token:  token,
+	}, err
+}
+func (c *GRPCSessionServer) Unlock(ctx context.Context, r *proto.UnlockRequest) (*proto.Empty, error) {
+	locker, ok := c.Impl.(session.Locker)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, session.ErrLockNotSupported.Error())
+	}
+	err := locker.Unlock(ctx, r.Key, r.Token)
+	return &proto.Empty{}, err
+}
 
 type GRPCSessionClient struct {
 	PluginClient *plugin.Client
@@ -49,6 +71,7 @@ type GRPCSessionClient struct {
 }
 
 var _ session.Session = &GRPCSessionClient{}
+var _ session.Locker = &GRPCSessionClient{}
 
 func (p *GRPCSessionClient) Get(ctx context.Context, key string) (string, error) {
 	r := &proto.GetRequest{
@@ -96,3 +119,28 @@ func (p *GRPCSessionClient) Close(ctx context.Context) error {
 	_, err := p.client.Close(ctx, &proto.Empty{})
 	return err
 }
+func (p *GRPCSessionClient) TryLock(ctx context.Context, key string, ttl time.Duration) (string, bool, error) {
+	r := &proto.LockRequest{
+		Key: key,
+		Ttl: ttl.Milliseconds(),
+	}
+	res, err := p.client.TryLock(ctx, r)
+	if err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			return "", false, session.ErrLockNotSupported
+		}
+		return "", false, err
+	}
+	return res.Token, res.Locked, nil
+}
+func (p *GRPCSessionClient) Unlock(ctx context.Context, key string, token string) error {
+	r := &proto.UnlockRequest{
+		Key:   key,
+		Token: token,
+	}
+	_, err := p.client.Unlock(ctx, r)
+	if status.Code(err) == codes.Unimplemented {
+		return session.ErrLockNotSupported
+	}
+	return err
+}
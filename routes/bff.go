@@ -0,0 +1,281 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/auth"
+	"golang.org/x/oauth2"
+)
+
+// forceRefreshSkew 有効期限に関わらずトークンを更新するためのskew
+const forceRefreshSkew = 100 * 365 * 24 * time.Hour
+
+// bffIdentity BFFのエンドポイントでセッションの認証情報を取得します。
+// SPAからのリクエストのため、未ログインの場合はリダイレクトせずLocationを付与して401を返します。
+func (h *handler) bffIdentity(ctx context.Context, w http.ResponseWriter, r *http.Request) (*identity, *sessions.Session, bool) {
+	id, session, err := h.loadIdentity(ctx, w, r, "id_token", true)
+	if err == unAuthorized {
+		w.Header().Set("WWW-Authenticate", h.realmChallenge())
+		UnAuthorizedResponse(w, h.conf.Login)
+		return nil, nil, false
+	}
+	if err != nil {
+		identityErrorResponse(h.log, w, err)
+		return nil, nil, false
+	}
+	return id, session, true
+}
+
+// allowedOrigin allowed_originsに設定されたオリジンかを返します。
+func (h *handler) allowedOrigin(origin string) bool {
+	for _, allowed := range h.conf.Bff.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// bffCORS allowed_originsのオリジンからのリクエストにCORSのヘッダーを付与し、プリフライトに応答します。
+func (h *handler) bffCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := origin != "" && h.allowedOrigin(origin)
+		w.Header().Add("Vary", "Origin")
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			next(w, r)
+			return
+		}
+		if !allowed {
+			ForbiddenResponse(w)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		w.Header().Set("Access-Control-Allow-Headers", "X-Requested-With")
+		w.Header().Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// sameOrigin BFFのエンドポイントへのリクエストが同一オリジン、または許可したオリジンからかを判定します。
+// プリフライトなしには送信できないX-Requested-Withヘッダーを必須とし、Originが送信された場合はホストと一致するかを確認します。
+// 他のオリジンからはbffCORSがプリフライトを許可したallowed_originsのみ送信できます。
+func (h *handler) sameOrigin(r *http.Request) bool {
+	if r.Header.Get("X-Requested-With") == "" {
+		return false
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if h.allowedOrigin(origin) {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func jsonResponse(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(v)
+}
+
+type userInfoResponse struct {
+	Claims   auth.Claims `json:"claims"`
+	UserInfo auth.Claims `json:"userinfo,omitempty"`
+}
+
+func (h *handler) bffUserInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, NewClient(r.Context()))
+	id, session, ok := h.bffIdentity(ctx, w, r)
+	if !ok {
+		return
+	}
+	userInfo, err := h.sessionUserInfo(ctx, w, r, id, session)
+	if err != nil {
+		// ユーザー情報を取得できない場合もIDトークンのクレームは返す
+		h.log.Warning(fmt.Sprintf("userinfo: %v", err))
+	}
+	jsonResponse(w, userInfoResponse{Claims: id.claims, UserInfo: userInfo})
+}
+
+// sessionUserInfo セッションのユーザー情報を返します。
+// キャッシュしていない場合はユーザー情報エンドポイントから取得し、次回のログインまでセッションへキャッシュします。
+func (h *handler) sessionUserInfo(ctx context.Context, w http.ResponseWriter, r *http.Request, id *identity, session *sessions.Session) (auth.Claims, error) {
+	if claims, ok := auth.UserInfoClaims(session); ok {
+		return claims, nil
+	}
+	authenticator, err := h.sessionProvider(session).cache.Authenticator()
+	if err != nil {
+		return nil, err
+	}
+	accessToken, _ := session.Values["access_token"].(string)
+	if !authenticator.HasUserInfo() || accessToken == "" {
+		return nil, nil
+	}
+	claims, err := authenticator.UserInfo(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	// 別のユーザーの情報を返さないよう、IDトークンのsubと一致するかを確認する(OpenID Connect Core 5.3.4)
+	if claims["sub"] != id.claims["sub"] {
+		return nil, fmt.Errorf("sub %v did not match the id token", claims["sub"])
+	}
+	auth.SetUserInfo(session, claims)
+	session.Save(r, w)
+	return claims, nil
+}
+
+type sessionResponse struct {
+	Authenticated bool        `json:"authenticated"`
+	Subject       interface{} `json:"sub,omitempty"`
+	// ExpiresAt IDトークンとアクセストークンのうち早い方の有効期限
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	ExpiresIn int64 `json:"expires_in,omitempty"`
+	// Refreshable 有効期限後もリフレッシュトークンで更新できるか
+	Refreshable bool `json:"refreshable"`
+}
+
+func (h *handler) bffSession(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if !h.sameOrigin(r) {
+			ForbiddenResponse(w)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, NewClient(r.Context()))
+	id, session, ok := h.bffIdentity(ctx, w, r)
+	if !ok {
+		return
+	}
+	refreshToken, _ := session.Values["refresh_token"].(string)
+	if r.Method == http.MethodPost && refreshToken != "" {
+		if !h.refreshBffSession(ctx, w, r, session) {
+			return
+		}
+	}
+	res := sessionResponse{
+		Authenticated: true,
+		Subject:       id.claims["sub"],
+		Refreshable:   refreshToken != "",
+	}
+	if expiry := sessionExpiry(session); !expiry.IsZero() {
+		res.ExpiresAt = expiry.Unix()
+		res.ExpiresIn = int64(time.Until(expiry).Seconds())
+	}
+	jsonResponse(w, res)
+}
+
+// refreshBffSession 有効期限に関わらずトークンを更新し、セッションを保存します。
+// 更新できなかった場合はレスポンスを書き込み、falseを返します。
+func (h *handler) refreshBffSession(ctx context.Context, w http.ResponseWriter, r *http.Request, session *sessions.Session) bool {
+	authenticator, err := h.sessionProvider(session).cache.Authenticator()
+	if err == nil {
+		err = refreshSession(ctx, authenticator, forceRefreshSkew, session)
+	}
+	if err == unAuthorized {
+		w.Header().Set("WWW-Authenticate", h.realmChallenge())
+		UnAuthorizedResponse(w, h.conf.Login)
+		return false
+	}
+	if err != nil {
+		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	session.Save(r, w)
+	return true
+}
+
+// sessionExpiry セッションが保持するIDトークンとアクセストークンのうち早い方の有効期限を返します。
+func sessionExpiry(session *sessions.Session) time.Time {
+	expiry := auth.IDTokenExpiry(session)
+	if tokenExpiry := auth.TokenExpiry(session); !tokenExpiry.IsZero() && (expiry.IsZero() || tokenExpiry.Before(expiry)) {
+		expiry = tokenExpiry
+	}
+	return expiry
+}
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in,omitempty"`
+}
+
+func (h *handler) bffToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.sameOrigin(r) {
+		ForbiddenResponse(w)
+		return
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, NewClient(r.Context()))
+	_, session, ok := h.bffIdentity(ctx, w, r)
+	if !ok {
+		return
+	}
+	p := h.sessionProvider(session)
+	authenticator, err := p.cache.Authenticator()
+	if err != nil {
+		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	conf := h.conf.Bff.TokenExchange
+	token, isSave, err := exchangeToken(ctx, conf, p.Oidc, authenticator, session)
+	if err == unAuthorized {
+		w.Header().Set("WWW-Authenticate", h.realmChallenge())
+		UnAuthorizedResponse(w, h.conf.Login)
+		return
+	}
+	if _, ok := err.(*oauth2.RetrieveError); ok {
+		h.log.Info(fmt.Sprintf("token exchange: %v", err))
+		ForbiddenResponse(w)
+		return
+	}
+	if err != nil {
+		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if isSave {
+		session.Save(r, w)
+	}
+	res := tokenResponse{AccessToken: token, TokenType: "Bearer"}
+	if expiry := auth.ExchangedTokenExpiry(session, conf); !expiry.IsZero() {
+		res.ExpiresIn = int64(time.Until(expiry).Seconds())
+	}
+	jsonResponse(w, res)
+}
+
+func (h *handler) BffUserInfo(pattern string) {
+	h.handleEndpoint(pattern, h.bffCORS(h.bffUserInfo))
+}
+
+func (h *handler) BffSession(pattern string) {
+	h.handleEndpoint(pattern, h.bffCORS(h.bffSession))
+}
+
+func (h *handler) BffToken(pattern string) {
+	h.handleEndpoint(pattern, h.bffCORS(h.bffToken))
+}
@@ -0,0 +1,130 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/logger"
+	"golang.org/x/oauth2"
+)
+
+// CheckResult 外部認可サービスとしてリクエストを判定した結果です。
+type CheckResult struct {
+	Allowed bool
+	// UpstreamHeaders 許可した場合にプロキシ先へのリクエストへ設定するヘッダー
+	UpstreamHeaders http.Header
+	// RemoveHeaders 許可した場合にプロキシ先へのリクエストから削除するヘッダー
+	RemoveHeaders []string
+	// Status 拒否した場合のステータスコード
+	Status int
+	// ResponseHeaders クライアントへのレスポンスへ追加するヘッダー(Set-Cookie、Locationなど)
+	ResponseHeaders http.Header
+	// Body 拒否した場合のレスポンスボディ
+	Body string
+}
+
+// responseRecorder ハンドラーが書き込んだレスポンスを記録します。
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{
+		header: http.Header{},
+	}
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(b)
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *responseRecorder) denied() *CheckResult {
+	return &CheckResult{
+		Status:          rec.status,
+		ResponseHeaders: rec.header,
+		Body:            rec.body.String(),
+	}
+}
+
+// Check プロキシと同じ認証・アクセス制御でリクエストを判定し、プロキシ先へ付与するヘッダーを返します。
+// 認証できない場合はプロキシと同様にログインへのリダイレクトまたは401を拒否レスポンスとして返します。
+// ログインやログアウトなどプロキシ自身のエンドポイントは常に許可します。
+func (h *handler) Check(r *http.Request) *CheckResult {
+	r = r.WithContext(logger.NewContext(r.Context(), h.log))
+	_, pattern := h.mux.Handler(r)
+	if h.endpoints[pattern] {
+		// ログインやログアウトは未認証でも到達できる必要があるため、プロキシ自身へそのまま転送させる
+		return &CheckResult{
+			Allowed: true,
+		}
+	}
+	value, ok := h.routes[pattern]
+	if !ok {
+		return &CheckResult{
+			Status: http.StatusForbidden,
+		}
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, NewClient(r.Context()))
+	rec := newResponseRecorder()
+	id, ok := h.authenticate(ctx, rec, r, value)
+	if !ok {
+		return rec.denied()
+	}
+	token, impersonationHeader, ok := h.impersonation(rec, value, id)
+	if !ok {
+		return rec.denied()
+	}
+	result := &CheckResult{
+		Allowed:         true,
+		UpstreamHeaders: http.Header{},
+		ResponseHeaders: rec.header,
+	}
+	if value.impersonator != nil {
+		result.RemoveHeaders = append(result.RemoveHeaders, "Authorization")
+		for name := range r.Header {
+			if isImpersonationHeader(name) {
+				result.RemoveHeaders = append(result.RemoveHeaders, name)
+			}
+		}
+		if token != "" {
+			result.UpstreamHeaders.Set("Authorization", "Bearer "+token)
+		}
+		for name, values := range impersonationHeader {
+			result.UpstreamHeaders[name] = values
+		}
+	} else {
+		result.UpstreamHeaders.Set("Authorization", value.url.Type+" "+id.token)
+	}
+	for name, claim := range value.location.Headers {
+		if v, ok := claimHeaderValue(id.claims, claim); ok {
+			result.UpstreamHeaders.Set(name, v)
+		} else {
+			result.RemoveHeaders = append(result.RemoveHeaders, name)
+		}
+	}
+	// 設定するヘッダーは上書きされるため削除の対象から除外する
+	removeHeaders := result.RemoveHeaders[:0]
+	for _, name := range result.RemoveHeaders {
+		if _, ok := result.UpstreamHeaders[http.CanonicalHeaderKey(name)]; !ok {
+			removeHeaders = append(removeHeaders, name)
+		}
+	}
+	result.RemoveHeaders = removeHeaders
+	return result
+}
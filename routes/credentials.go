@@ -0,0 +1,83 @@
+package routes
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/auth"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// clientCredentials プロキシ先へ転送するプロキシ自身のトークンを取得します。
+// トークンはロケーション毎に共有され、有効期限が切れるまで再利用されます。
+type clientCredentials struct {
+	ctx   context.Context
+	conf  config.ClientCredentials
+	cache *auth.Cache
+
+	mu sync.Mutex
+	// tokenURL tsを生成した際のトークンエンドポイント
+	tokenURL string
+	ts       oauth2.TokenSource
+}
+
+func newClientCredentials(ctx context.Context, conf config.ClientCredentials, cache *auth.Cache) *clientCredentials {
+	return &clientCredentials{
+		ctx:   ctx,
+		conf:  conf,
+		cache: cache,
+	}
+}
+
+// config トークンエンドポイントが未設定の場合は、取得の度にIdPの最新のディスカバリ情報から解決します。
+func (c *clientCredentials) config() (*clientcredentials.Config, error) {
+	tokenURL := c.conf.TokenUrl
+	authStyle := oauth2.AuthStyleAutoDetect
+	if tokenURL == "" {
+		authenticator, err := c.cache.Authenticator()
+		if err != nil {
+			return nil, err
+		}
+		tokenURL = authenticator.Config.Endpoint.TokenURL
+		authStyle = authenticator.Config.Endpoint.AuthStyle
+	}
+	params := url.Values{}
+	for key, value := range c.conf.EndpointParams {
+		params.Set(key, value)
+	}
+	return &clientcredentials.Config{
+		ClientID:       c.conf.ClientId,
+		ClientSecret:   c.conf.ClientSecret,
+		TokenURL:       tokenURL,
+		Scopes:         c.conf.Scopes,
+		EndpointParams: params,
+		AuthStyle:      authStyle,
+	}, nil
+}
+
+// Token 有効なトークンを返します。有効期限が切れている場合は再取得します。
+// ディスカバリ情報でトークンエンドポイントが変わった場合のみTokenSourceを作り直し、IdPへの問い合わせはロックの外で行います。
+func (c *clientCredentials) Token() (*oauth2.Token, error) {
+	ts, err := c.tokenSource()
+	if err != nil {
+		return nil, err
+	}
+	return ts.Token()
+}
+
+func (c *clientCredentials) tokenSource() (oauth2.TokenSource, error) {
+	cc, err := c.config()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ts == nil || c.tokenURL != cc.TokenURL {
+		c.ts = oauth2.ReuseTokenSource(nil, cc.TokenSource(c.ctx))
+		c.tokenURL = cc.TokenURL
+	}
+	return c.ts, nil
+}
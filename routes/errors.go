@@ -35,15 +35,24 @@ type errorBody struct {
 }
 
 func UnAuthorizedResponse(w http.ResponseWriter, location string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
 	if location != "" {
 		w.Header().Set("Location", location)
 	}
-	w.WriteHeader(http.StatusUnauthorized)
+	errorJSONResponse(w, http.StatusUnauthorized)
+}
+
+// ForbiddenResponse アクセス制御の条件を満たさない場合のレスポンスです。
+func ForbiddenResponse(w http.ResponseWriter) {
+	errorJSONResponse(w, http.StatusForbidden)
+}
+
+func errorJSONResponse(w http.ResponseWriter, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
 	errBody := errorBody{
-		StatusCode: http.StatusUnauthorized,
-		Message:    http.StatusText(http.StatusUnauthorized),
+		StatusCode: status,
+		Message:    http.StatusText(status),
 	}
 	buf, err := json.Marshal(&errBody)
 	if err == nil {
@@ -55,3 +64,23 @@ func responseError(log logger.ILogger, w http.ResponseWriter, err string, code i
 	log.Critical(err)
 	http.Error(w, err, code)
 }
+
+// unavailableError IdPへ接続できないなど、IdPの障害により認証できなかったことを表します。
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+// identityErrorResponse 認証情報を取得できなかった場合のレスポンスです。
+// IdPの障害の場合は内部のエラーをレスポンスへ含めずに503を返します。
+func identityErrorResponse(log logger.ILogger, w http.ResponseWriter, err error) {
+	if _, ok := err.(*unavailableError); ok {
+		log.Error(err.Error())
+		errorJSONResponse(w, http.StatusServiceUnavailable)
+		return
+	}
+	responseError(log, w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,115 @@
+package routes
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// ExtAuthzServer Envoyの外部認可サービス(envoy.service.auth.v3.Authorization)です。
+// チェックリクエストのホストに対応するバーチャルサーバーでプロキシと同じ判定を行います。
+type ExtAuthzServer struct {
+	authv3.UnimplementedAuthorizationServer
+	hosts *MultiHost
+}
+
+var _ authv3.AuthorizationServer = &ExtAuthzServer{}
+
+// NewExtAuthzServer hostsは設定の再読込で入れ替わるため、参照を保持します。
+func NewExtAuthzServer(hosts *MultiHost) *ExtAuthzServer {
+	return &ExtAuthzServer{
+		hosts: hosts,
+	}
+}
+
+// Register gRPCサーバーへ外部認可サービスを登録します。
+func (s *ExtAuthzServer) Register(server *grpc.Server) {
+	authv3.RegisterAuthorizationServer(server, s)
+}
+
+func (s *ExtAuthzServer) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	r, err := checkRequest(ctx, req)
+	if err != nil {
+		return deniedResponse(&CheckResult{Status: http.StatusBadRequest}), nil
+	}
+	result := s.hosts.Check(r)
+	if !result.Allowed {
+		return deniedResponse(result), nil
+	}
+	ok := &authv3.OkHttpResponse{
+		Headers:              headerValueOptions(result.UpstreamHeaders),
+		HeadersToRemove:      result.RemoveHeaders,
+		ResponseHeadersToAdd: headerValueOptions(result.ResponseHeaders),
+	}
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{
+			OkResponse: ok,
+		},
+	}, nil
+}
+
+// checkRequest チェックリクエストの属性からHTTPリクエストを組み立てます。
+func checkRequest(ctx context.Context, req *authv3.CheckRequest) (*http.Request, error) {
+	attrs := req.GetAttributes().GetRequest().GetHttp()
+	u, err := url.ParseRequestURI(attrs.GetPath())
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = attrs.GetScheme()
+	u.Host = attrs.GetHost()
+	method := attrs.GetMethod()
+	if method == "" {
+		method = http.MethodGet
+	}
+	r, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range attrs.GetHeaders() {
+		// :authorityなどの疑似ヘッダーは除外する
+		if strings.HasPrefix(name, ":") {
+			continue
+		}
+		r.Header.Set(name, value)
+	}
+	r.Host = attrs.GetHost()
+	r.RequestURI = attrs.GetPath()
+	return r, nil
+}
+
+func deniedResponse(result *CheckResult) *authv3.CheckResponse {
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(codes.PermissionDenied)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(result.Status)},
+				Headers: headerValueOptions(result.ResponseHeaders),
+				Body:    result.Body,
+			},
+		},
+	}
+}
+
+func headerValueOptions(header http.Header) []*corev3.HeaderValueOption {
+	var options []*corev3.HeaderValueOption
+	for name, values := range header {
+		for i, value := range values {
+			options = append(options, &corev3.HeaderValueOption{
+				Header: &corev3.HeaderValue{Key: name, Value: value},
+				// 複数の値を持つヘッダー(Set-Cookieなど)は2つ目以降を追加する
+				Append: wrapperspb.Bool(i > 0),
+			})
+		}
+	}
+	return options
+}
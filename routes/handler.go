@@ -3,14 +3,17 @@ package routes
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"html/template"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc"
@@ -19,6 +22,7 @@ import (
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/auth"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/logger"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/store"
 	"golang.org/x/oauth2"
 )
 
@@ -28,6 +32,18 @@ type handler struct {
 	conf config.Servers
 	mux  *http.ServeMux
 	log  logger.ILogger
+	ctx  context.Context
+	// providers 先頭はoidcに設定されたIdP
+	providers []*provider
+	routes    map[string]proxyValue
+	// endpoints ログインやログアウトなどプロキシ自身が処理するパス
+	endpoints map[string]bool
+	// providerChooser IdPの選択画面のテンプレート
+	providerChooser *template.Template
+	// bearers 同じ信頼する発行者の設定はJWKSのキャッシュを共有する
+	bearers map[string]*auth.BearerVerifier
+	// credentials 同じ設定のクライアントクレデンシャルはトークンを共有する
+	credentials map[string]*clientCredentials
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -37,6 +53,20 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.mux.ServeHTTP(w, r)
 }
 
+// handleEndpoint プロキシ自身が処理するエンドポイントを登録します。
+func (h *handler) handleEndpoint(pattern string, handler http.HandlerFunc) {
+	h.endpoints[pattern] = true
+	h.mux.HandleFunc(pattern, handler)
+}
+
+func randomValue() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
 func (h *handler) login(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	c := NewClient(r.Context())
@@ -46,36 +76,79 @@ func (h *handler) login(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		return
 	}
+	p := h.chooseProvider(w, r)
+	if p == nil {
+		return
+	}
 	// Generate random state
-	b := make([]byte, 32)
-	_, err := rand.Read(b)
+	state, err := randomValue()
+	if err != nil {
+		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomValue()
 	if err != nil {
 		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	state := base64.StdEncoding.EncodeToString(b)
 
 	session, err := app.Store.Store(conf.ServerName).Get(r, conf.CookieName)
 	if err != nil {
 		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	session.Values["state"] = state
-	err = session.Save(r, w)
+	authenticator, err := p.cache.Authenticator()
 	if err != nil {
 		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	authenticator, err := auth.NewAuthenticator(ctx, conf.Oidc)
+	login := pendingLogin{
+		Nonce:    nonce,
+		Provider: p.Name,
+	}
+	if rd := r.URL.Query().Get("rd"); rd != "" {
+		if isValidRedirect(rd, h.redirectDomains(r)) {
+			login.Redirect = rd
+		} else {
+			h.log.Warning(fmt.Sprintf("login: invalid redirect %q", rd))
+		}
+	}
+	opts := p.Oidc.SetValues()
+	if !p.Oidc.IsOAuth2() {
+		opts = append(opts, oidc.Nonce(nonce))
+	}
+	if hint := r.URL.Query().Get("login_hint"); hint != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("login_hint", hint))
+	}
+	opts = append(opts, stepUpOptions(r.URL.Query(), &login)...)
+	if p.Oidc.IsPkce() {
+		if p.Oidc.IsPkceRequired() && !authenticator.SupportsPKCE() {
+			responseError(h.log, w, "provider does not support PKCE (S256)", http.StatusInternalServerError)
+			return
+		}
+		verifier, err := auth.NewCodeVerifier()
+		if err != nil {
+			responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		login.CodeVerifier = verifier
+		opts = append(opts, auth.CodeChallengeOptions(verifier)...)
+	}
+	err = saveSession(r, w, session, func(session *sessions.Session) {
+		if id := r.URL.Query().Get("rq"); id != "" && login.Redirect != "" {
+			login.Request = takeSavedRequest(session, id, login.Redirect)
+		}
+		addPendingLogin(session, state, login)
+	})
 	if err != nil {
 		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.Redirect(w, r, authenticator.Config.AuthCodeURL(state, conf.Oidc.SetValues()...), http.StatusTemporaryRedirect)
+	http.Redirect(w, r, authenticator.Config.AuthCodeURL(state, opts...), http.StatusTemporaryRedirect)
 }
 
 func (h *handler) Login(pattern string) {
-	h.mux.HandleFunc(pattern, h.login)
+	h.handleEndpoint(pattern, h.login)
 }
 
 func (h *handler) callback(w http.ResponseWriter, r *http.Request) {
@@ -92,85 +165,417 @@ func (h *handler) callback(w http.ResponseWriter, r *http.Request) {
 		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if r.URL.Query().Get("state") != session.Values["state"] {
+	// 認可リクエストは取り出した時点で保存し、同じstateでのコールバックを一度だけ受け付ける
+	var login pendingLogin
+	var ok bool
+	if !session.IsNew {
+		err = saveSession(r, w, session, func(session *sessions.Session) {
+			login, ok = takePendingLogin(session, r.URL.Query().Get("state"))
+		})
+		if err != nil {
+			responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if !ok {
+		http.Redirect(w, r, conf.Login, http.StatusTemporaryRedirect)
+		return
+	}
+	p := h.providerByName(login.Provider)
+	if p == nil {
 		http.Redirect(w, r, conf.Login, http.StatusTemporaryRedirect)
 		return
 	}
-
-	authenticator, err := auth.NewAuthenticator(ctx, conf.Oidc)
+	authenticator, err := p.cache.Authenticator()
 	if err != nil {
 		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	token, err := authenticator.Config.Exchange(ctx, r.URL.Query().Get("code"), conf.Oidc.SetValues()...)
+	opts := p.Oidc.SetValues()
+	if p.Oidc.IsPkce() {
+		if login.CodeVerifier == "" {
+			http.Redirect(w, r, conf.Login, http.StatusTemporaryRedirect)
+			return
+		}
+		opts = append(opts, auth.CodeVerifierOption(login.CodeVerifier))
+	}
+	nonce := login.Nonce
+
+	token, err := authenticator.Exchange(ctx, r.URL.Query().Get("code"), opts...)
 	if err != nil {
 		h.log.Critical(fmt.Sprintf("no token found: %v", err))
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	rawIDToken, ok := token.Extra("id_token").(string)
-	if !ok {
-		responseError(h.log, w, "No id_token field in oauth2 token.", http.StatusInternalServerError)
-		return
-	}
+	var subject string
+	var claims auth.Claims
+	if authenticator.IsOAuth2() {
+		if subject, err = h.oauth2Session(ctx, authenticator, token, session); err != nil {
+			responseError(h.log, w, "Failed to get userinfo: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		claims, _ = auth.UserInfoClaims(session)
+	} else {
+		rawIDToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			responseError(h.log, w, "No id_token field in oauth2 token.", http.StatusInternalServerError)
+			return
+		}
 
-	oidcConfig := &oidc.Config{
-		ClientID: conf.Oidc.ClientId,
-	}
+		oidcConfig := &oidc.Config{
+			ClientID: p.Oidc.ClientId,
+		}
 
-	_, err = authenticator.Provider.Verifier(oidcConfig).Verify(ctx, rawIDToken)
+		idToken, err := authenticator.Verifier(oidcConfig).Verify(ctx, rawIDToken)
 
-	if err != nil {
-		responseError(h.log, w, "Failed to verify ID Token: "+err.Error(), http.StatusInternalServerError)
+		if err != nil {
+			responseError(h.log, w, "Failed to verify ID Token: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if nonce == "" || subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+			responseError(h.log, w, "Failed to verify ID Token: nonce did not match", http.StatusUnauthorized)
+			return
+		}
+
+		// var profile map[string]interface{}
+		// if err := idToken.Claims(&profile); err != nil {
+		// 	responseError(h.log,w, err.Error(), http.StatusInternalServerError)
+		// 	return
+		// }
+		// session.Values["profile"] = profile
+		if err := idToken.Claims(&claims); err != nil {
+			responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		delete(session.Values, "refresh_token")
+		delete(session.Values, "scope")
+		delete(session.Values, "userinfo")
+		auth.SetTokenSession(session, token)
+		auth.SetIDTokenExpiry(session, idToken.Expiry)
+		if sid, _ := claims["sid"].(string); sid != "" {
+			session.Values["sid"] = sid
+		} else {
+			delete(session.Values, "sid")
+		}
+		subject = idToken.Subject
+	}
+	if err := verifyStepUp(login, claims); err != nil {
+		// セッションは保存せず、ログイン前の認証を維持する
+		h.log.Info(fmt.Sprintf("step-up authentication: %v (sub: %v)", err, subject))
+		ForbiddenResponse(w)
 		return
 	}
-
-	// var profile map[string]interface{}
-	// if err := idToken.Claims(&profile); err != nil {
-	// 	responseError(h.log,w, err.Error(), http.StatusInternalServerError)
-	// 	return
-	// }
-	// session.Values["profile"] = profile
-	auth.SetTokenSession(session, token)
-	err = session.Save(r, w)
+	session.Values["provider"] = p.Name
+	// 保存時にインデックスの有効期限もセッションと併せて延長される
+	store.SetIndexes(session, sessionIndexKeys(p, subject, session))
+	err = saveSession(r, w, session, nil)
 	if err != nil {
 		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	redirect, ok := session.Values["redirect"].(string)
-	if !ok {
+	if err := h.indexSession(session); err != nil {
+		h.log.Error(fmt.Sprintf("session index error: %v", err))
+	}
+	if login.Request != nil {
+		// 中断したフォームの送信をログイン後に再送する
+		h.renderReplay(w, r, login.Request)
+		return
+	}
+	redirect := login.Redirect
+	if redirect == "" {
 		redirect = "/"
 	}
 	http.Redirect(w, r, redirect, http.StatusSeeOther)
 }
 
+// oauth2Session IDトークンを発行しないプロバイダの場合に、ユーザー情報を取得してトークンと共にセッションへ保存します。
+// セッションはアクセストークンが有効、または更新できる間有効です。
+func (h *handler) oauth2Session(ctx context.Context, authenticator *auth.Authenticator, token *oauth2.Token, session *sessions.Session) (string, error) {
+	claims, err := authenticator.UserInfo(ctx, token.AccessToken)
+	if err != nil {
+		return "", err
+	}
+	for _, key := range []string{"id_token", "refresh_token", "scope", "sid"} {
+		delete(session.Values, key)
+	}
+	auth.SetTokenSession(session, token)
+	auth.SetIDTokenExpiry(session, token.Expiry)
+	auth.SetUserInfo(session, claims)
+	subject, _ := claims["sub"].(string)
+	return subject, nil
+}
+
 func (h *handler) Callback(pattern string) {
-	h.mux.HandleFunc(pattern, h.callback)
+	h.handleEndpoint(pattern, h.callback)
 }
 
 func (h *handler) logout(w http.ResponseWriter, r *http.Request) {
 	conf := h.conf
-	logoutUrl, err := url.Parse(conf.Oidc.Logout)
-
+	sessionStore := app.Store.Store(conf.ServerName)
+	session, err := sessionStore.Get(r, conf.CookieName)
+	if err != nil {
+		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rawIDToken, _ := session.Values["id_token"].(string)
+	p := h.sessionProvider(session)
+	// 静的に設定されたログアウトURLが優先される
+	if p.Oidc.Logout != "" {
+		logoutUrl, err := url.Parse(p.Oidc.Logout)
+		if err != nil {
+			responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		session.Options = &sessions.Options{MaxAge: -1}
+		session.Save(r, w)
+		h.deleteSession(session)
+		http.Redirect(w, r, logoutUrl.String(), http.StatusTemporaryRedirect)
+		return
+	}
+	authenticator, err := p.cache.Authenticator()
+	if err != nil {
+		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var state string
+	if p.Oidc.PostLogoutRedirectUrl != "" {
+		if state, err = randomValue(); err != nil {
+			responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	logoutUrl, err := authenticator.EndSessionURL(rawIDToken, p.Oidc.PostLogoutRedirectUrl, state)
 	if err != nil {
 		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if logoutUrl == "" || state == "" {
+		session.Options = &sessions.Options{MaxAge: -1}
+		session.Save(r, w)
+		h.deleteSession(session)
+		if logoutUrl == "" {
+			logoutUrl = "/"
+		}
+		http.Redirect(w, r, logoutUrl, http.StatusTemporaryRedirect)
+		return
+	}
+	// ログイン中のセッションを破棄し、ログアウト後の戻り先で検証するstateのみを新しいセッションへ保存する
+	h.deleteSession(session)
+	session.ID = ""
+	session.Values = map[interface{}]interface{}{
+		"logout_state": state,
+	}
+	if err := session.Save(r, w); err != nil {
+		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, logoutUrl, http.StatusTemporaryRedirect)
+}
+
+func (h *handler) Logout(pattern string) {
+	h.handleEndpoint(pattern, h.logout)
+}
+
+func (h *handler) postLogout(w http.ResponseWriter, r *http.Request) {
+	conf := h.conf
 	session, err := app.Store.Store(conf.ServerName).Get(r, conf.CookieName)
 	if err != nil {
 		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	state, _ := session.Values["logout_state"].(string)
 	session.Options = &sessions.Options{MaxAge: -1}
 	session.Save(r, w)
-	app.Store.Store(conf.ServerName).Delete(session)
-	http.Redirect(w, r, logoutUrl.String(), http.StatusTemporaryRedirect)
+	if state == "" || subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("state")), []byte(state)) != 1 {
+		responseError(h.log, w, "invalid logout state", http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-func (h *handler) Logout(pattern string) {
-	h.mux.HandleFunc(pattern, h.logout)
+func (h *handler) PostLogout(pattern string) {
+	h.handleEndpoint(pattern, h.postLogout)
+}
+
+// sessionIndexKeys IdPからのログアウト通知でセッションを削除するためのsidとsubのインデックスを返します。
+func sessionIndexKeys(p *provider, subject string, session *sessions.Session) []string {
+	var indexKeys []string
+	if sid, _ := session.Values["sid"].(string); sid != "" {
+		indexKeys = append(indexKeys, p.indexKey("sid", sid))
+	}
+	if subject != "" {
+		indexKeys = append(indexKeys, p.indexKey("sub", subject))
+	}
+	return indexKeys
+}
+
+// indexSession sidとsubからセッションIDを引けるようにします。既に削除されたセッションは登録時に取り除かれます。
+func (h *handler) indexSession(session *sessions.Session) error {
+	sessionStore := app.Store.Store(h.conf.ServerName)
+	for _, indexKey := range store.Indexes(session) {
+		if err := sessionStore.AddIndex(indexKey, session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSession セッションを削除し、sidとsubのインデックスからも取り除きます。
+func (h *handler) deleteSession(session *sessions.Session) {
+	sessionStore := app.Store.Store(h.conf.ServerName)
+	for _, indexKey := range store.Indexes(session) {
+		if err := sessionStore.RemoveIndex(indexKey, session.ID); err != nil {
+			h.log.Warning(fmt.Sprintf("remove session index: %v", err))
+		}
+	}
+	sessionStore.Delete(session)
+}
+
+func (h *handler) backchannelLogout(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(r.Context(), oauth2.HTTPClient, NewClient(r.Context()))
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p, logoutToken, err := h.verifyLogoutToken(ctx, r.PostFormValue("logout_token"))
+	if err != nil {
+		h.log.Warning(fmt.Sprintf("back-channel logout: %v", err))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_request"}`))
+		return
+	}
+	// sidが含まれる場合はそのセッションのみ、含まれない場合はsubの全てのセッションを削除する
+	indexKey := p.indexKey("sub", logoutToken.Subject)
+	if logoutToken.SessionID != "" {
+		indexKey = p.indexKey("sid", logoutToken.SessionID)
+	}
+	deleted, err := app.Store.Store(h.conf.ServerName).DeleteByIndex(indexKey)
+	if err != nil {
+		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.log.Info(fmt.Sprintf("back-channel logout: %d session(s) deleted", deleted))
+	w.WriteHeader(http.StatusOK)
+}
+
+// verifyLogoutToken ログアウトトークンをいずれかのIdPで検証し、検証できたIdPを返します。
+func (h *handler) verifyLogoutToken(ctx context.Context, rawToken string) (*provider, *auth.LogoutToken, error) {
+	var lastErr error
+	for _, p := range h.providers {
+		authenticator, err := p.cache.Authenticator()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		logoutToken, err := authenticator.VerifyLogoutToken(ctx, rawToken)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return p, logoutToken, nil
+	}
+	return nil, nil, lastErr
+}
+
+func (h *handler) BackchannelLogout(pattern string) {
+	h.handleEndpoint(pattern, h.backchannelLogout)
+}
+
+const frontchannelLogoutPage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Logged out</title></head><body></body></html>
+`
+
+func (h *handler) frontchannelLogout(w http.ResponseWriter, r *http.Request) {
+	conf := h.conf
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	iss, sid := q.Get("iss"), q.Get("sid")
+	if sid != "" && iss == "" {
+		// sidを指定する場合はissも必須(OpenID Connect Front-Channel Logout 1.0 2章)
+		responseError(h.log, w, "front-channel logout: iss is required with sid", http.StatusBadRequest)
+		return
+	}
+	// issが指定されない場合は全てのIdPのセッションを対象とする
+	providers := h.providers
+	if iss != "" {
+		p := h.providerByIssuer(iss)
+		if p == nil {
+			responseError(h.log, w, "front-channel logout: issuer did not match", http.StatusBadRequest)
+			return
+		}
+		providers = []*provider{p}
+	}
+	// ログアウトの対象はブラウザのセッションのみ
+	// sidが指定されない場合、またはブラウザのセッションのsidと一致する場合にCookieとsidが同じサーバー側のセッションを破棄する
+	sessionStore := app.Store.Store(conf.ServerName)
+	if session, err := sessionStore.Get(r, conf.CookieName); err == nil && !session.IsNew {
+		p := h.sessionProvider(session)
+		current, _ := session.Values["sid"].(string)
+		if containsProvider(providers, p) && (sid == "" || current == sid) {
+			if current != "" {
+				if _, err := sessionStore.DeleteByIndex(p.indexKey("sid", current)); err != nil {
+					responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			session.Options = &sessions.Options{MaxAge: -1}
+			session.Save(r, w)
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(frontchannelLogoutPage))
+}
+
+func containsProvider(providers []*provider, p *provider) bool {
+	for _, candidate := range providers {
+		if candidate == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *handler) FrontchannelLogout(pattern string) {
+	h.handleEndpoint(pattern, h.frontchannelLogout)
+}
+
+func (h *handler) authCheck(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, NewClient(r.Context()))
+	conf := h.conf
+	headers := conf.GetAuthCheckHeaders()
+	id, _, err := h.loadIdentity(ctx, w, r, "id_token", true)
+	if err == unAuthorized {
+		login := conf.Login
+		if rd := forwardedURL(r); rd != "" {
+			login += "?" + url.Values{"rd": {rd}}.Encode()
+		}
+		UnAuthorizedResponse(w, login)
+		return
+	}
+	if err != nil {
+		identityErrorResponse(h.log, w, err)
+		return
+	}
+	for name, claim := range headers {
+		if value, ok := claimHeaderValue(id.claims, claim); ok {
+			w.Header().Set(name, value)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handler) AuthCheck(pattern string) {
+	h.handleEndpoint(pattern, h.authCheck)
 }
 
 type proxyContextKey struct{}
@@ -178,50 +583,288 @@ type proxyContextKey struct{}
 var proxyKey proxyContextKey
 
 type proxyValue struct {
-	registry         *Registry
-	host             string
-	isProxySslVerify bool
-	tokenType        string
-	tokenKey         string
+	registry     *Registry
+	host         string
+	location     config.Locations
+	url          config.Urls
+	bearer       *auth.BearerVerifier
+	impersonator *impersonator
+	credentials  *clientCredentials
 }
 
 func fromProxyContext(ctx context.Context) proxyValue {
 	return ctx.Value(proxyKey).(proxyValue)
 }
 
-func (h *handler) proxy(w http.ResponseWriter, r *http.Request) {
-	value := fromProxyContext(r.Context())
-	registry := value.registry
-	host := value.host
-	typ := value.tokenType
-	tokenKey := value.tokenKey
-	isProxySslVerify := value.isProxySslVerify
-	ctx := context.Background()
+func bearerToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	return ""
+}
+
+// identity 認証されたリクエストのプロキシ先へ転送するトークンとクレームです。
+type identity struct {
+	token  string
+	claims auth.Claims
+	scopes []string
+}
+
+// loadIdentity Cookieのセッションから認証情報を取得します。トークンを更新した場合はセッションを保存します。
+// withClaimsがtrueの場合はIDトークンのクレームも取得します。
+// セッションが無効な場合はunAuthorizedを返します。
+func (h *handler) loadIdentity(ctx context.Context, w http.ResponseWriter, r *http.Request, tokenKey string, withClaims bool) (*identity, *sessions.Session, error) {
 	conf := h.conf
-	log := h.log
 	session, err := app.Store.Store(conf.ServerName).Get(r, conf.CookieName)
 	if err != nil {
-		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, nil, err
+	}
+	p := h.sessionProvider(session)
+	authenticator, err := p.cache.Authenticator()
+	if err != nil {
+		return nil, session, err
+	}
+	rawToken, isSave, err := Token(ctx, tokenKey, p.Oidc, authenticator, session)
+	if err != nil {
+		return nil, session, err
+	}
+	if isSave {
+		session.Save(r, w)
+	}
+	id := &identity{
+		token:  rawToken,
+		scopes: auth.GrantedScopes(session, p.Oidc.Scopes),
+	}
+	if withClaims {
+		if id.claims, err = sessionClaims(ctx, authenticator, session); err != nil {
+			return nil, session, err
+		}
+	}
+	return id, session, nil
+}
+
+// sessionIdentity Cookieのセッションからプロキシ先へ転送するトークンを取得します。
+// 取得できなかった場合はレスポンスを書き込み、falseを返します。
+// トークン交換が設定されている場合は交換したトークンを転送します。
+func (h *handler) sessionIdentity(ctx context.Context, w http.ResponseWriter, r *http.Request, value proxyValue, withClaims bool) (*identity, bool) {
+	id, session, err := h.loadIdentity(ctx, w, r, value.url.Token, withClaims)
+	if err == nil && value.url.RequiresStepUp() {
+		if stepUpErr := auth.CheckAuthentication(id.claims, value.url.Acr, value.url.GetMaxAge()); stepUpErr != nil {
+			h.log.Info(fmt.Sprintf("step-up authentication: %v (sub: %v)", stepUpErr, id.claims["sub"]))
+			h.stepUp(w, r, value, session)
+			return nil, false
+		}
+	}
+	if err == nil && value.location.TokenExchange.IsEnabled() {
+		err = h.exchangeIdentity(ctx, w, r, value.location.TokenExchange, id, session)
+	}
+	if err == unAuthorized {
+		h.loginRequired(w, r, value, session, url.Values{}, "")
+		return nil, false
+	}
+	if _, ok := err.(*oauth2.RetrieveError); ok {
+		// IdPが交換を拒否した場合はプロキシ先へのアクセスを許可しない
+		h.log.Info(fmt.Sprintf("token exchange: %v", err))
+		ForbiddenResponse(w)
+		return nil, false
+	}
+	if err != nil {
+		identityErrorResponse(h.log, w, err)
+		return nil, false
+	}
+	return id, true
+}
+
+// exchangeIdentity 転送するトークンを交換したトークンへ置き換えます。IdPへ交換を要求した場合はセッションを保存します。
+func (h *handler) exchangeIdentity(ctx context.Context, w http.ResponseWriter, r *http.Request, conf config.TokenExchange, id *identity, session *sessions.Session) error {
+	p := h.sessionProvider(session)
+	authenticator, err := p.cache.Authenticator()
+	if err != nil {
+		return err
+	}
+	token, isSave, err := exchangeToken(ctx, conf, p.Oidc, authenticator, session)
+	if err != nil {
+		return err
+	}
+	if isSave {
+		session.Save(r, w)
+	}
+	id.token = token
+	return nil
+}
+
+// bearerIdentity Authorizationヘッダーのベアラートークンを検証します。
+// APIクライアントはCookieのセッションを持たないため、ログインへのリダイレクトは行いません。
+func (h *handler) bearerIdentity(ctx context.Context, w http.ResponseWriter, value proxyValue, rawBearer string, withClaims bool) (*identity, bool) {
+	if value.location.Bearer.Introspection && !value.bearer.Trusted(rawBearer) {
+		return h.introspectedIdentity(ctx, w, value, rawBearer)
+	}
+	token, err := value.bearer.Verify(ctx, rawBearer)
+	if err != nil {
+		h.log.Warning(fmt.Sprintf("bearer token: %v", err))
+		invalidTokenResponse(w)
+		return nil, false
+	}
+	id := &identity{
+		token: rawBearer,
+	}
+	if value.location.Bearer.Token != "" {
+		id.token = value.location.Bearer.Token
+	}
+	if withClaims {
+		if err := token.Claims(&id.claims); err != nil {
+			responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+			return nil, false
+		}
+	}
+	return id, true
+}
+
+// introspectedIdentity JWTではないベアラートークンをデフォルトのIdPのイントロスペクションで検証します。
+// audまたはclient_idがintrospection_audiencesに含まれないトークンは拒否します。
+// クレームはイントロスペクションのレスポンスから取得します。
+func (h *handler) introspectedIdentity(ctx context.Context, w http.ResponseWriter, value proxyValue, rawBearer string) (*identity, bool) {
+	authenticator, err := h.defaultProvider().cache.Authenticator()
+	if err != nil {
+		identityErrorResponse(h.log, w, &unavailableError{err: err})
+		return nil, false
 	}
-	var rawToken string
-	rawToken, isSave, err := Token(ctx, tokenKey, conf.Oidc, session)
+	result, err := authenticator.Introspect(ctx, rawBearer)
 	if err != nil {
-		if err == unAuthorized {
-			if conf.Redirect {
-				session.Values["redirect"] = r.RequestURI
-				session.Save(r, w)
-				http.Redirect(w, r, conf.Login, http.StatusTemporaryRedirect)
-			} else {
-				UnAuthorizedResponse(w, conf.Login)
+		// IdPの障害は内部のエラーを返さず503とする
+		identityErrorResponse(h.log, w, &unavailableError{err: err})
+		return nil, false
+	}
+	if !result.Active {
+		h.log.Warning("bearer token: inactive token")
+		invalidTokenResponse(w)
+		return nil, false
+	}
+	// 他のクライアント向けに発行されたトークンは受け付けない
+	if !result.HasAudience(value.location.Bearer.IntrospectionAudiences) {
+		h.log.Warning(fmt.Sprintf("bearer token: invalid audience %v", result.Audiences()))
+		invalidTokenResponse(w)
+		return nil, false
+	}
+	id := &identity{
+		token:  rawBearer,
+		claims: result.Claims,
+		scopes: result.Scopes(),
+	}
+	if value.location.Bearer.Token != "" {
+		id.token = value.location.Bearer.Token
+	}
+	return id, true
+}
+
+func invalidTokenResponse(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	UnAuthorizedResponse(w, "")
+}
+
+// authorize アクセス制御の条件を満たさない場合は403を返し、falseを返します。
+func (h *handler) authorize(w http.ResponseWriter, rules []config.Access, id *identity) bool {
+	if err := auth.Authorize(rules, id.claims, id.scopes); err != nil {
+		h.log.Info(fmt.Sprintf("%v (sub: %v)", err, id.claims["sub"]))
+		ForbiddenResponse(w)
+		return false
+	}
+	return true
+}
+
+func accessRules(location config.Locations, path config.Urls) []config.Access {
+	var rules []config.Access
+	for _, rule := range []config.Access{location.Access, path.Access} {
+		if rule.IsEnabled() {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// authenticate ベアラートークンまたはCookieのセッションでリクエストを認証し、アクセス制御を行います。
+// 認証できなかった場合はレスポンスを書き込み、falseを返します。
+func (h *handler) authenticate(ctx context.Context, w http.ResponseWriter, r *http.Request, value proxyValue) (*identity, bool) {
+	rules := accessRules(value.location, value.url)
+	withClaims := len(rules) > 0 || len(value.location.Headers) > 0 || value.impersonator != nil || value.url.RequiresStepUp()
+	var id *identity
+	var ok bool
+	if rawBearer := bearerToken(r); value.bearer != nil && rawBearer != "" {
+		id, ok = h.bearerIdentity(ctx, w, value, rawBearer, withClaims)
+		if ok && value.url.RequiresStepUp() {
+			if err := auth.CheckAuthentication(id.claims, value.url.Acr, value.url.GetMaxAge()); err != nil {
+				h.log.Info(fmt.Sprintf("step-up authentication: %v (sub: %v)", err, id.claims["sub"]))
+				insufficientAuthenticationResponse(w, value.url)
+				return nil, false
 			}
-		} else {
+		}
+	} else {
+		id, ok = h.sessionIdentity(ctx, w, r, value, withClaims)
+	}
+	if !ok {
+		return nil, false
+	}
+	if len(rules) > 0 && !h.authorize(w, rules, id) {
+		return nil, false
+	}
+	if value.credentials != nil {
+		// ユーザーはプロキシで認証し、プロキシ先へはプロキシ自身のトークンを転送する
+		token, err := value.credentials.Token()
+		if err != nil {
 			responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+			return nil, false
 		}
+		id.token = token.AccessToken
+	}
+	return id, true
+}
+
+// impersonation 偽装モードの場合にプロキシ自身のトークンとImpersonate-*ヘッダーを返します。
+func (h *handler) impersonation(w http.ResponseWriter, value proxyValue, id *identity) (string, http.Header, bool) {
+	if value.impersonator == nil {
+		return "", nil, true
+	}
+	header, err := value.impersonator.headers(id.claims)
+	if err != nil {
+		h.log.Info(err.Error())
+		ForbiddenResponse(w)
+		return "", nil, false
+	}
+	token, err := value.impersonator.bearerToken()
+	if err != nil {
+		responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+		return "", nil, false
+	}
+	return token, header, true
+}
+
+func (h *handler) proxy(w http.ResponseWriter, r *http.Request) {
+	value := fromProxyContext(r.Context())
+	registry := value.registry
+	host := value.host
+	typ := value.url.Type
+	isProxySslVerify := value.location.IsProxySSLVerify()
+	ctx := context.Background()
+	c := NewClient(r.Context())
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, c)
+	log := h.log
+	id, ok := h.authenticate(ctx, w, r, value)
+	if !ok {
 		return
 	}
-	if isSave {
-		session.Save(r, w)
+	impersonationToken, impersonationHeader, ok := h.impersonation(w, value, id)
+	if !ok {
+		return
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: isProxySslVerify,
+	}
+	if value.impersonator != nil {
+		if err := value.impersonator.configureTLS(tlsConfig); err != nil {
+			responseError(h.log, w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 	}
 
 	director := func(req *http.Request) {
@@ -240,9 +883,7 @@ func (h *handler) proxy(w http.ResponseWriter, r *http.Request) {
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: isProxySslVerify,
-		},
+		TLSClientConfig:       tlsConfig,
 		Dial: func(network, addr string) (net.Conn, error) {
 			d := &net.Dialer{}
 			for i := 0; i < len(registry.Endpoints); i++ {
@@ -258,7 +899,13 @@ func (h *handler) proxy(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 	rt = NewDumpTransport(r.Context(), rt)
-	rt = NewAuthorizationTransport(typ, rawToken, rt)
+	if value.impersonator != nil {
+		// ユーザーのトークンはプロキシ先へ転送しない
+		rt = NewImpersonationTransport(impersonationToken, impersonationHeader, rt)
+	} else {
+		rt = NewAuthorizationTransport(typ, id.token, rt)
+	}
+	rt = NewIdentityHeaderTransport(value.location.Headers, id.claims, rt)
 	reverse := &httputil.ReverseProxy{
 		Director:      director,
 		ErrorHandler:  errorResponse(log),
@@ -268,15 +915,42 @@ func (h *handler) proxy(w http.ResponseWriter, r *http.Request) {
 	reverse.ServeHTTP(w, r)
 }
 
-func (h *handler) Proxy(pattern string, registry *Registry, host, typ, tokenKey string, isProxySslVerify bool) {
-	h.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
-		value := proxyValue{
-			registry:         registry,
-			host:             host,
-			tokenType:        typ,
-			tokenKey:         tokenKey,
-			isProxySslVerify: isProxySslVerify,
+func (h *handler) Proxy(pattern string, registry *Registry, host string, location config.Locations, path config.Urls) {
+	var bearer *auth.BearerVerifier
+	if location.Bearer.IsEnabled() {
+		key := fmt.Sprintf("%v", location.Bearer.Issuers)
+		if bearer = h.bearers[key]; bearer == nil {
+			bearer = auth.NewBearerVerifier(h.ctx, location.Bearer.Issuers)
+			h.bearers[key] = bearer
 		}
+	}
+	var impersonator *impersonator
+	if location.Impersonation.Enabled {
+		impersonator = newImpersonator(location.Impersonation)
+	}
+	var credentials *clientCredentials
+	if location.ClientCredentials.IsEnabled() {
+		key := fmt.Sprintf("%v", location.ClientCredentials)
+		if credentials = h.credentials[key]; credentials == nil {
+			p := h.defaultProvider()
+			if name := location.ClientCredentials.Provider; name != "" {
+				p = h.providerByName(name)
+			}
+			credentials = newClientCredentials(h.ctx, location.ClientCredentials, p.cache)
+			h.credentials[key] = credentials
+		}
+	}
+	value := proxyValue{
+		registry:     registry,
+		host:         host,
+		location:     location,
+		url:          path,
+		bearer:       bearer,
+		impersonator: impersonator,
+		credentials:  credentials,
+	}
+	h.routes[pattern] = value
+	h.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		ctx = context.WithValue(ctx, proxyKey, value)
 		*r = *r.WithContext(ctx)
@@ -289,15 +963,59 @@ type Handler interface {
 	Login(pattern string)
 	Callback(pattern string)
 	Logout(pattern string)
-	Proxy(pattern string, registry *Registry, host, typ, tokenKey string, isProxySslVerify bool)
+	PostLogout(pattern string)
+	BackchannelLogout(pattern string)
+	FrontchannelLogout(pattern string)
+	AuthCheck(pattern string)
+	// BffUserInfo セッションのクレームとユーザー情報を返すエンドポイントを登録します。
+	BffUserInfo(pattern string)
+	// BffSession セッションの有効期限を返し、POSTでトークンを更新するエンドポイントを登録します。
+	BffSession(pattern string)
+	// BffToken 交換したアクセストークンを返すエンドポイントを登録します。
+	BffToken(pattern string)
+	// Check 外部認可サービスとしてリクエストを判定します。
+	Check(r *http.Request) *CheckResult
+	Proxy(pattern string, registry *Registry, host string, location config.Locations, path config.Urls)
+	// Close キャッシュしているプロバイダ情報を破棄します。
+	Close() error
+}
+
+func (h *handler) Close() error {
+	for _, p := range h.providers {
+		p.cache.Close()
+	}
+	return nil
 }
 
-func new(conf config.Servers) Handler {
+func new(conf config.Servers) *handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/favicon.ico", func(rw http.ResponseWriter, r *http.Request) {})
+	log := conf.Logging.GetLogger()
+	ctx := logger.NewContext(context.Background(), log)
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, NewClient(ctx))
+	var providers []*provider
+	for _, p := range conf.GetProviders() {
+		providers = append(providers, &provider{
+			Provider: p,
+			cache:    auth.NewCache(ctx, p.Oidc),
+		})
+	}
+	for _, p := range providers {
+		// 最初のリクエストを待たずにディスカバリ情報を取得する。失敗した場合はリクエスト時に再取得する
+		if _, err := p.cache.Authenticator(); err != nil {
+			log.Error(fmt.Sprintf("%s: oidc discovery error: %v", p.Name, err))
+		}
+	}
 	return &handler{
-		conf: conf,
-		mux:  mux,
-		log:  conf.Logging.GetLogger(),
+		conf:            conf,
+		mux:             mux,
+		log:             log,
+		ctx:             ctx,
+		providers:       providers,
+		routes:          map[string]proxyValue{},
+		endpoints:       map[string]bool{},
+		bearers:         map[string]*auth.BearerVerifier{},
+		credentials:     map[string]*clientCredentials{},
+		providerChooser: defaultProviderChooser,
 	}
 }
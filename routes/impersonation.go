@@ -0,0 +1,186 @@
+package routes
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/auth"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+)
+
+const (
+	impersonateUserHeader        = "Impersonate-User"
+	impersonateGroupHeader       = "Impersonate-Group"
+	impersonateUidHeader         = "Impersonate-Uid"
+	impersonateExtraHeaderPrefix = "Impersonate-Extra-"
+)
+
+// credentialReloadInterval ServiceAccountのトークンやクライアント証明書のローテーションに追従するため再読込する間隔です。
+const credentialReloadInterval = time.Minute
+
+var errNoImpersonationUser = errors.New("impersonation: no user claim")
+
+// impersonator kube-apiserverへプロキシ自身の認証情報で接続するための情報を保持します。
+type impersonator struct {
+	conf config.Impersonation
+
+	mu            sync.Mutex
+	token         string
+	tokenLoadedAt time.Time
+	cert          *tls.Certificate
+	certLoadedAt  time.Time
+	caPool        *x509.CertPool
+	caLoadedAt    time.Time
+}
+
+func newImpersonator(conf config.Impersonation) *impersonator {
+	return &impersonator{
+		conf: conf,
+	}
+}
+
+// configureTLS クライアント証明書とCA証明書をTLSの設定へ反映します。
+func (i *impersonator) configureTLS(tlsConfig *tls.Config) error {
+	if i.conf.CaFile != "" {
+		pool, err := i.rootCAs()
+		if err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if i.conf.ClientCert != "" {
+		tlsConfig.GetClientCertificate = i.clientCertificate
+	}
+	return nil
+}
+
+func (i *impersonator) rootCAs() (*x509.CertPool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.caPool != nil && time.Since(i.caLoadedAt) < credentialReloadInterval {
+		return i.caPool, nil
+	}
+	buf, err := ioutil.ReadFile(i.conf.CaFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("impersonation: no certificates in %s", i.conf.CaFile)
+	}
+	i.caPool = pool
+	i.caLoadedAt = time.Now()
+	return pool, nil
+}
+
+func (i *impersonator) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.cert != nil && time.Since(i.certLoadedAt) < credentialReloadInterval {
+		return i.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(i.conf.ClientCert, i.conf.ClientKey)
+	if err != nil {
+		return nil, err
+	}
+	i.cert = &cert
+	i.certLoadedAt = time.Now()
+	return i.cert, nil
+}
+
+func (i *impersonator) bearerToken() (string, error) {
+	tokenFile := i.conf.GetTokenFile()
+	if tokenFile == "" {
+		return "", nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.token != "" && time.Since(i.tokenLoadedAt) < credentialReloadInterval {
+		return i.token, nil
+	}
+	buf, err := ioutil.ReadFile(tokenFile)
+	if err != nil {
+		return "", err
+	}
+	i.token = strings.TrimSpace(string(buf))
+	i.tokenLoadedAt = time.Now()
+	return i.token, nil
+}
+
+// headers クレームからImpersonate-*ヘッダーを生成します。
+func (i *impersonator) headers(claims auth.Claims) (http.Header, error) {
+	user, ok := claimHeaderValue(claims, i.conf.GetUserClaim())
+	if !ok || user == "" {
+		return nil, errNoImpersonationUser
+	}
+	header := http.Header{}
+	header.Set(impersonateUserHeader, i.conf.UserPrefix+user)
+	for _, group := range claims.Strings(i.conf.GetGroupsClaim()) {
+		header.Add(impersonateGroupHeader, i.conf.GroupsPrefix+group)
+	}
+	for _, claim := range i.conf.ExtraClaims {
+		key := impersonateExtraHeaderPrefix + url.PathEscape(claim)
+		if values := claims.Strings(claim); len(values) > 0 {
+			for _, value := range values {
+				header.Add(key, value)
+			}
+		} else if value, ok := claimHeaderValue(claims, claim); ok {
+			header.Add(key, value)
+		}
+	}
+	return header, nil
+}
+
+// ImpersonationTransport クライアントの認証情報と偽装ヘッダーを削除し、プロキシ自身の認証情報と偽装ヘッダーを付与します。
+type ImpersonationTransport struct {
+	Transport http.RoundTripper
+	token     string
+	header    http.Header
+}
+
+func NewImpersonationTransport(token string, header http.Header, transport http.RoundTripper) http.RoundTripper {
+	return &ImpersonationTransport{
+		Transport: transport,
+		token:     token,
+		header:    header,
+	}
+}
+
+func (t *ImpersonationTransport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+func (t *ImpersonationTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.Header.Del("Authorization")
+	for name := range r.Header {
+		if isImpersonationHeader(name) {
+			r.Header.Del(name)
+		}
+	}
+	if t.token != "" {
+		r.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	for name, values := range t.header {
+		r.Header[name] = values
+	}
+	return t.transport().RoundTrip(r)
+}
+
+func isImpersonationHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return name == impersonateUserHeader ||
+		name == impersonateGroupHeader ||
+		name == impersonateUidHeader ||
+		strings.HasPrefix(name, impersonateExtraHeaderPrefix)
+}
@@ -3,12 +3,16 @@ package routes
 import (
 	"context"
 	"errors"
+	"strings"
+	"time"
 
 	"github.com/coreos/go-oidc"
 	"github.com/gorilla/sessions"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/auth"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/store"
 	"golang.org/x/oauth2"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
@@ -16,37 +20,40 @@ var (
 	noTokenKey   = errors.New("no token key")
 )
 
-func Token(ctx context.Context, tokenKey string, oidcConf config.Oidc, session *sessions.Session) (string, bool, error) {
+func Token(ctx context.Context, tokenKey string, oidcConf config.Oidc, authenticator *auth.Authenticator, session *sessions.Session) (string, bool, error) {
 	var rawToken string
 	var isSave bool = false
 	var resultErr error
+	if authenticator.IsOAuth2() {
+		return oauth2Token(ctx, tokenKey, oidcConf, authenticator, session)
+	}
 	rawIdToken, ok := session.Values["id_token"].(string)
 	if !ok {
 		return rawToken, isSave, unAuthorized
 	}
 	if rawIdToken != "" {
-		authenticator, err := auth.NewAuthenticator(ctx, oidcConf)
+		// IDトークンの検証(有効期限はセッションに保存した値で判定する)
+		idToken, err := authenticator.Verifier(&oidc.Config{
+			ClientID:        authenticator.Config.ClientID,
+			SkipExpiryCheck: true,
+		}).Verify(ctx, rawIdToken)
 		if err != nil {
-			return "", isSave, err
+			return "", false, unAuthorized
 		}
-		oidcConfig := &oidc.Config{
-			ClientID: oidcConf.ClientId,
+		if auth.IDTokenExpiry(session).IsZero() {
+			auth.SetIDTokenExpiry(session, idToken.Expiry)
 		}
-		// IDトークンの検証
-		_, err = authenticator.Provider.Verifier(oidcConfig).Verify(ctx, rawIdToken)
-		if err != nil {
+		skew := oidcConf.GetRefreshSkew()
+		if needsRefresh(session, skew) {
 			// トークンの更新
-			refreshToken := session.Values["refresh_token"].(string)
-			ts := authenticator.Config.TokenSource(ctx, &oauth2.Token{
-				RefreshToken: refreshToken,
-			})
-			if token, err := ts.Token(); err != nil {
+			if err := refreshSession(ctx, authenticator, skew, session); err != nil {
 				return "", false, err
-			} else {
-				auth.SetTokenSession(session, token)
-				isSave = true
 			}
-			// session.Save(r, w)
+			isSave = true
+			rawIdToken, _ = session.Values["id_token"].(string)
+		}
+		if err := introspectSession(ctx, oidcConf, authenticator, session); err != nil {
+			return "", false, err
 		}
 		// プロキシ先へ転送するトークンを取得
 		rawToken, ok = session.Values[tokenKey].(string)
@@ -54,8 +61,230 @@ func Token(ctx context.Context, tokenKey string, oidcConf config.Oidc, session *
 			resultErr = noTokenKey
 			rawToken = rawIdToken
 		}
+		// 再発行されずに期限切れとなったIDトークンは転送せず、再ログインを求める
+		if rawToken == rawIdToken && !auth.IDTokenExpiry(session).After(time.Now()) {
+			return "", false, unAuthorized
+		}
 	} else {
 		return "", false, unAuthorized
 	}
 	return rawToken, isSave, resultErr
 }
+
+// oauth2Token IDトークンを発行しないプロバイダのセッションからプロキシ先へ転送するトークンを取得します。
+// IDトークンの代わりにアクセストークンを転送します。
+func oauth2Token(ctx context.Context, tokenKey string, oidcConf config.Oidc, authenticator *auth.Authenticator, session *sessions.Session) (string, bool, error) {
+	if _, ok := auth.UserInfoClaims(session); !ok {
+		return "", false, unAuthorized
+	}
+	if accessToken, _ := session.Values["access_token"].(string); accessToken == "" {
+		return "", false, unAuthorized
+	}
+	isSave := false
+	skew := oidcConf.GetRefreshSkew()
+	if needsRefresh(session, skew) {
+		if err := refreshSession(ctx, authenticator, skew, session); err != nil {
+			return "", false, err
+		}
+		isSave = true
+	}
+	if err := introspectSession(ctx, oidcConf, authenticator, session); err != nil {
+		return "", false, err
+	}
+	if tokenKey == "id_token" {
+		tokenKey = "access_token"
+	}
+	rawToken, ok := session.Values[tokenKey].(string)
+	if !ok {
+		return "", isSave, noTokenKey
+	}
+	return rawToken, isSave, nil
+}
+
+// introspectSession セッションのアクセストークンがIdPで無効化されていないかをイントロスペクションで確認します。
+// 無効なトークンはログアウトしたセッションとして扱います。
+func introspectSession(ctx context.Context, oidcConf config.Oidc, authenticator *auth.Authenticator, session *sessions.Session) error {
+	if !oidcConf.Introspection {
+		return nil
+	}
+	accessToken, _ := session.Values["access_token"].(string)
+	if accessToken == "" {
+		return unAuthorized
+	}
+	result, err := authenticator.Introspect(ctx, accessToken)
+	if err != nil {
+		return &unavailableError{err: err}
+	}
+	if !result.Active {
+		return unAuthorized
+	}
+	return nil
+}
+
+// sessionClaims セッションが保持するIDトークンのクレームを返します。
+// OAuth2のプロバイダの場合はキャッシュしたユーザー情報のクレームを返します。
+func sessionClaims(ctx context.Context, authenticator *auth.Authenticator, session *sessions.Session) (auth.Claims, error) {
+	if authenticator.IsOAuth2() {
+		claims, ok := auth.UserInfoClaims(session)
+		if !ok {
+			return nil, unAuthorized
+		}
+		return claims, nil
+	}
+	rawIdToken, _ := session.Values["id_token"].(string)
+	idToken, err := authenticator.Verifier(&oidc.Config{
+		ClientID:        authenticator.Config.ClientID,
+		SkipExpiryCheck: true,
+	}).Verify(ctx, rawIdToken)
+	if err != nil {
+		return nil, err
+	}
+	var claims auth.Claims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// refreshToken リフレッシュトークンでトークンを更新し、セッションへ反映します。
+// IDトークンが返却された場合は検証を行い、返却されなかった場合は保存済みのIDトークンを維持します。
+// リフレッシュトークンを持たないOAuth2のセッションは、ユーザー情報エンドポイントで再検証します。
+func refreshToken(ctx context.Context, authenticator *auth.Authenticator, session *sessions.Session) error {
+	refreshToken, _ := session.Values["refresh_token"].(string)
+	if refreshToken == "" && authenticator.IsOAuth2() {
+		// GitHubなど有効期限のないアクセストークンは、取り消されていないかをユーザー情報エンドポイントで定期的に確認する
+		err := authenticator.RevalidateUserInfo(ctx, session)
+		if err == auth.ErrUserInfoUnauthorized {
+			return unAuthorized
+		}
+		return err
+	}
+	if refreshToken == "" {
+		return unAuthorized
+	}
+	token, err := authenticator.Refresh(ctx, refreshToken)
+	if err != nil {
+		if _, ok := err.(*oauth2.RetrieveError); ok {
+			return unAuthorized
+		}
+		return err
+	}
+	if authenticator.IsOAuth2() {
+		auth.SetTokenSession(session, token)
+		auth.SetIDTokenExpiry(session, token.Expiry)
+		return nil
+	}
+	rawIdToken, _ := token.Extra("id_token").(string)
+	if rawIdToken == "" {
+		// IDトークンが再発行されない場合は保存済みのIDトークンの有効期限を維持する
+		auth.SetTokenSession(session, token)
+		auth.SetIDTokenStale(session)
+		return nil
+	}
+	idToken, err := authenticator.Verifier(&oidc.Config{
+		ClientID: authenticator.Config.ClientID,
+	}).Verify(ctx, rawIdToken)
+	if err != nil {
+		return unAuthorized
+	}
+	auth.SetTokenSession(session, token)
+	auth.SetIDTokenExpiry(session, idToken.Expiry)
+	return nil
+}
+
+var refreshGroup singleflight.Group
+
+const (
+	refreshLockTTL     = 30 * time.Second
+	refreshLockTimeout = 10 * time.Second
+)
+
+// refreshSession 同一セッションに対するトークン更新をまとめて1回だけ実行します。
+// プロセス内ではセッションID毎に更新を集約し、レプリカ間ではセッションストアのロックで排他制御を行います。
+// 他のリクエストやレプリカが既に更新していた場合は、その結果をセッションへ反映します。
+func refreshSession(ctx context.Context, authenticator *auth.Authenticator, skew time.Duration, session *sessions.Session) error {
+	key := session.Name() + "/" + session.ID
+	v, err, _ := refreshGroup.Do(key, func() (interface{}, error) {
+		current := sessions.NewSession(session.Store(), session.Name())
+		current.ID = session.ID
+		for k, val := range session.Values {
+			current.Values[k] = val
+		}
+		sessionStore, ok := session.Store().(*store.SessionStore)
+		if !ok || session.ID == "" {
+			if err := refreshToken(ctx, authenticator, current); err != nil {
+				return nil, err
+			}
+			return current.Values, nil
+		}
+		lockCtx, cancel := context.WithTimeout(ctx, refreshLockTimeout)
+		defer cancel()
+		unlock, err := sessionStore.Lock(lockCtx, session.ID, refreshLockTTL)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		if err := sessionStore.Reload(current); err != nil {
+			return nil, unAuthorized
+		}
+		if !needsRefresh(current, skew) {
+			return current.Values, nil
+		}
+		if err := refreshToken(ctx, authenticator, current); err != nil {
+			return nil, err
+		}
+		if err := sessionStore.Update(current); err != nil {
+			return nil, err
+		}
+		return current.Values, nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, val := range v.(map[interface{}]interface{}) {
+		session.Values[k] = val
+	}
+	return nil
+}
+
+// needsRefresh トークンの更新が必要かを返します。
+// 更新してもIDトークンが再発行されなかった場合は、アクセストークンの有効期限のみで判定します。
+func needsRefresh(session *sessions.Session, skew time.Duration) bool {
+	if !auth.IDTokenStale(session) && expiresWithin(auth.IDTokenExpiry(session), skew) {
+		return true
+	}
+	return expiresWithin(auth.TokenExpiry(session), skew)
+}
+
+func expiresWithin(expiry time.Time, skew time.Duration) bool {
+	if expiry.IsZero() {
+		return false
+	}
+	return time.Now().Add(skew).After(expiry)
+}
+
+var exchangeGroup singleflight.Group
+
+// exchangeToken セッションのアクセストークンをプロキシ先向けのトークンへ交換します(RFC 8693)。
+// 交換したトークンはセッションへキャッシュし、有効期限が近づくかアクセストークンが更新されるまで再利用します。
+// IdPへ交換を要求した場合はセッションの保存が必要なためtrueを返します。
+func exchangeToken(ctx context.Context, conf config.TokenExchange, oidcConf config.Oidc, authenticator *auth.Authenticator, session *sessions.Session) (string, bool, error) {
+	subjectToken, _ := session.Values["access_token"].(string)
+	if subjectToken == "" {
+		return "", false, unAuthorized
+	}
+	skew := oidcConf.GetRefreshSkew()
+	if token, ok := auth.ExchangedToken(session, conf, subjectToken, skew); ok {
+		return token, false, nil
+	}
+	key := strings.Join([]string{session.Name(), session.ID, conf.Audience, conf.Resource, strings.Join(conf.Scopes, " "), conf.RequestedTokenType}, "/")
+	v, err, _ := exchangeGroup.Do(key, func() (interface{}, error) {
+		return authenticator.ExchangeToken(ctx, subjectToken, conf)
+	})
+	if err != nil {
+		return "", false, err
+	}
+	token := v.(*oauth2.Token)
+	auth.SetExchangedToken(session, conf, subjectToken, token)
+	return token.AccessToken, true, nil
+}
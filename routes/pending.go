@@ -0,0 +1,139 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/store"
+)
+
+const (
+	// maxPendingLogins セッション毎に保持するコールバック待ちの認可リクエストの上限
+	maxPendingLogins = 10
+	// pendingLoginTTL 認可リクエストの有効期間
+	pendingLoginTTL = 10 * time.Minute
+)
+
+// pendingLogin コールバックを待っている認可リクエストです。
+// 複数のタブで同時にログインしても互いに上書きしないよう、stateをキーにセッションへ保存します。
+type pendingLogin struct {
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"code_verifier,omitempty"`
+	// Redirect ログイン後の戻り先(検証済み)
+	Redirect string `json:"redirect,omitempty"`
+	// Provider 認可リクエストを送信したIdPの名前
+	Provider  string `json:"provider"`
+	AcrValues string `json:"acr_values,omitempty"`
+	MaxAge    int    `json:"max_age,omitempty"`
+	// Request ログイン後に再送する中断したリクエスト
+	Request *savedRequest `json:"request,omitempty"`
+	Expires int64         `json:"expires"`
+}
+
+func (l *pendingLogin) expired(now time.Time) bool {
+	return now.Unix() >= l.Expires
+}
+
+// sessionJSON セッションの値をvへ変換します。
+// セッションストアはJSONで保存するため、読込後の値はJSONを経由して変換します。
+func sessionJSON(session *sessions.Session, key string, v interface{}) {
+	raw, ok := session.Values[key]
+	if !ok {
+		return
+	}
+	if buf, err := json.Marshal(raw); err == nil {
+		json.Unmarshal(buf, v)
+	}
+}
+
+// pendingKeys ログインと並行して他のリクエストが更新するセッションのキー
+var pendingKeys = []string{"logins", "saved_requests"}
+
+// saveSession セッションを保存します。updateが指定された場合は保存前に適用します。
+// 認可リクエストと中断したリクエストはセッションのロックを取得した上でバックエンドの最新の値を使用するため、
+// 複数のタブで同時にログインしても互いに追加した値を上書きしません。
+func saveSession(r *http.Request, w http.ResponseWriter, session *sessions.Session, update func(*sessions.Session)) error {
+	sessionStore, ok := session.Store().(*store.SessionStore)
+	if !ok || session.ID == "" {
+		if update != nil {
+			update(session)
+		}
+		return session.Save(r, w)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), refreshLockTimeout)
+	defer cancel()
+	unlock, err := sessionStore.Lock(ctx, session.ID, refreshLockTTL)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	current := sessions.NewSession(sessionStore, session.Name())
+	current.ID = session.ID
+	// 削除されたセッションは読み込んだ値のまま保存する
+	if err := sessionStore.Reload(current); err == nil {
+		for _, key := range pendingKeys {
+			if value, ok := current.Values[key]; ok {
+				session.Values[key] = value
+			} else {
+				delete(session.Values, key)
+			}
+		}
+	}
+	if update != nil {
+		update(session)
+	}
+	return session.Save(r, w)
+}
+
+// pendingLogins セッションが保持する認可リクエストを返します。
+func pendingLogins(session *sessions.Session) map[string]pendingLogin {
+	logins := map[string]pendingLogin{}
+	sessionJSON(session, "logins", &logins)
+	return logins
+}
+
+func setPendingLogins(session *sessions.Session, logins map[string]pendingLogin) {
+	if len(logins) == 0 {
+		delete(session.Values, "logins")
+		return
+	}
+	session.Values["logins"] = logins
+}
+
+// addPendingLogin 認可リクエストを保存します。上限を超える場合は最も古いものを破棄します。
+func addPendingLogin(session *sessions.Session, state string, login pendingLogin) {
+	now := time.Now()
+	login.Expires = now.Add(pendingLoginTTL).Unix()
+	logins := pendingLogins(session)
+	for key, l := range logins {
+		if l.expired(now) {
+			delete(logins, key)
+		}
+	}
+	for len(logins) >= maxPendingLogins {
+		var oldest string
+		for key, l := range logins {
+			if oldest == "" || l.Expires < logins[oldest].Expires {
+				oldest = key
+			}
+		}
+		delete(logins, oldest)
+	}
+	logins[state] = login
+	setPendingLogins(session, logins)
+}
+
+// takePendingLogin stateに対応する認可リクエストを取り出します。一度取り出したリクエストは再利用できません。
+func takePendingLogin(session *sessions.Session, state string) (pendingLogin, bool) {
+	logins := pendingLogins(session)
+	login, ok := logins[state]
+	delete(logins, state)
+	setPendingLogins(session, logins)
+	if !ok || state == "" || login.expired(time.Now()) {
+		return pendingLogin{}, false
+	}
+	return login, true
+}
@@ -0,0 +1,79 @@
+package routes
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/session"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPendingLogins(t *testing.T) {
+	session := sessions.NewSession(nil, "session")
+	for i := 0; i < maxPendingLogins+2; i++ {
+		addPendingLogin(session, fmt.Sprintf("state-%d", i), pendingLogin{Redirect: fmt.Sprintf("/%d", i)})
+	}
+	assert.Len(t, pendingLogins(session), maxPendingLogins)
+
+	login, ok := takePendingLogin(session, fmt.Sprintf("state-%d", maxPendingLogins+1))
+	if assert.True(t, ok) {
+		assert.Equal(t, fmt.Sprintf("/%d", maxPendingLogins+1), login.Redirect)
+	}
+	// 同じstateは再利用できない
+	_, ok = takePendingLogin(session, fmt.Sprintf("state-%d", maxPendingLogins+1))
+	assert.False(t, ok)
+	_, ok = takePendingLogin(session, "")
+	assert.False(t, ok)
+}
+
+// slowSession 読込と書込を遅延させ、並行したリクエストの更新が重なるようにするバックエンドです。
+type slowSession struct {
+	session.Session
+	session.Locker
+}
+
+func (s *slowSession) Get(ctx context.Context, key string) (string, error) {
+	time.Sleep(10 * time.Millisecond)
+	return s.Session.Get(ctx, key)
+}
+
+func (s *slowSession) Put(ctx context.Context, key string, value string) error {
+	time.Sleep(10 * time.Millisecond)
+	return s.Session.Put(ctx, key, value)
+}
+
+func TestSaveSessionConcurrentLogins(t *testing.T) {
+	memory := session.NewLocalMemory()
+	sessionStore := store.NewStore(&slowSession{Session: memory, Locker: memory}, []byte("something-very-secret"))
+	initial := sessions.NewSession(sessionStore, "session")
+	initial.Options = &sessions.Options{}
+	if !assert.NoError(t, sessionStore.Save(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder(), initial)) {
+		return
+	}
+	const tabs = 5
+	var wg sync.WaitGroup
+	for i := 0; i < tabs; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// 各タブのリクエストは他のタブが保存する前のセッションを読み込んでいる
+			current := sessions.NewSession(sessionStore, "session")
+			current.ID = initial.ID
+			current.Options = &sessions.Options{}
+			sessionStore.Reload(current)
+			err := saveSession(httptest.NewRequest("GET", "/oauth2/login", nil), httptest.NewRecorder(), current, func(session *sessions.Session) {
+				addPendingLogin(session, fmt.Sprintf("state-%d", i), pendingLogin{})
+			})
+			assert.NoError(t, err)
+		}(i)
+	}
+	wg.Wait()
+	assert.NoError(t, sessionStore.Reload(initial))
+	assert.Len(t, pendingLogins(initial), tabs)
+}
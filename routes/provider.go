@@ -0,0 +1,153 @@
+package routes
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/auth"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+)
+
+// provider IdP毎の設定とAuthenticatorのキャッシュです。
+type provider struct {
+	config.Provider
+	cache *auth.Cache
+}
+
+// indexKey IdPからのログアウト通知でセッションを引くためのキーを返します。
+// IdP間でsidやsubが重複しないよう、default以外はIdPの名前を付与します。
+func (p *provider) indexKey(kind, value string) string {
+	if p.Name == config.DefaultProviderName {
+		return kind + "_" + value
+	}
+	return p.Name + "_" + kind + "_" + value
+}
+
+func (h *handler) defaultProvider() *provider {
+	return h.providers[0]
+}
+
+func (h *handler) providerByName(name string) *provider {
+	for _, p := range h.providers {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// providerByIssuer issが一致するIdPを返します。
+// ディスカバリ情報を取得できないIdPは、他のIdPへの通知を妨げないよう除外します。
+func (h *handler) providerByIssuer(iss string) *provider {
+	for _, p := range h.providers {
+		authenticator, err := p.cache.Authenticator()
+		if err != nil {
+			h.log.Error(fmt.Sprintf("%s: oidc discovery error: %v", p.Name, err))
+			continue
+		}
+		if authenticator.Issuer == iss {
+			return p
+		}
+	}
+	return nil
+}
+
+// sessionProvider セッションのトークンを発行したIdPを返します。
+func (h *handler) sessionProvider(session *sessions.Session) *provider {
+	if name, _ := session.Values["provider"].(string); name != "" {
+		if p := h.providerByName(name); p != nil {
+			return p
+		}
+	}
+	return h.defaultProvider()
+}
+
+// providerByLoginHint login_hintのメールアドレスのドメインからIdPを返します。
+func (h *handler) providerByLoginHint(hint string) *provider {
+	i := strings.LastIndex(hint, "@")
+	if i < 0 {
+		return nil
+	}
+	domain := hint[i+1:]
+	for _, p := range h.providers {
+		for _, d := range p.Domains {
+			if strings.EqualFold(domain, strings.TrimPrefix(d, "@")) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// chooseProvider ログインに使用するIdPを返します。
+// providerパラメータ、login_hintの順に判定し、決まらない場合は選択画面を表示してnilを返します。
+// 存在しないIdPが指定された場合は400を返します。
+func (h *handler) chooseProvider(w http.ResponseWriter, r *http.Request) *provider {
+	q := r.URL.Query()
+	if name := q.Get("provider"); name != "" {
+		p := h.providerByName(name)
+		if p == nil {
+			responseError(h.log, w, "unknown provider", http.StatusBadRequest)
+		}
+		return p
+	}
+	if p := h.providerByLoginHint(q.Get("login_hint")); p != nil {
+		return p
+	}
+	if len(h.providers) == 1 {
+		return h.defaultProvider()
+	}
+	h.renderProviderChooser(w, r)
+	return nil
+}
+
+const providerChooserPage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Sign in</title></head>
+<body>
+<h1>Sign in</h1>
+<ul>
+{{- range .Providers}}
+<li><a href="{{.URL}}">{{.DisplayName}}</a></li>
+{{- end}}
+</ul>
+</body></html>
+`
+
+var defaultProviderChooser = template.Must(template.New("providers").Parse(providerChooserPage))
+
+// providerChoice 選択画面のテンプレートへ渡すIdPです。
+type providerChoice struct {
+	Name        string
+	DisplayName string
+	URL         string
+}
+
+// providerChooser provider_templateを読み込みます。未設定の場合は既定の選択画面を返します。
+func providerChooser(conf config.Servers) (*template.Template, error) {
+	if conf.ProviderTemplate == "" {
+		return defaultProviderChooser, nil
+	}
+	return template.ParseFiles(conf.ProviderTemplate)
+}
+
+func (h *handler) renderProviderChooser(w http.ResponseWriter, r *http.Request) {
+	choices := make([]providerChoice, 0, len(h.providers))
+	for _, p := range h.providers {
+		q := r.URL.Query()
+		q.Set("provider", p.Name)
+		choices = append(choices, providerChoice{
+			Name:        p.Name,
+			DisplayName: p.GetDisplayName(),
+			URL:         (&url.URL{Path: r.URL.Path, RawQuery: q.Encode()}).String(),
+		})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := h.providerChooser.Execute(w, struct{ Providers []providerChoice }{choices}); err != nil {
+		h.log.Error(err.Error())
+	}
+}
@@ -0,0 +1,141 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+)
+
+// isValidRedirect ログイン後の戻り先として許可するURLかを判定します。
+// 同一ホストのパス、または許可されたドメインのhttp(s)のURLのみ許可します。
+func isValidRedirect(rd string, domains []string) bool {
+	if rd == "" || strings.ContainsAny(rd, "\\\r\n\t") {
+		return false
+	}
+	u, err := url.Parse(rd)
+	if err != nil {
+		return false
+	}
+	if u.Scheme == "" && u.Host == "" {
+		// //evil.example.com のようなスキーム相対URLは許可しない
+		return strings.HasPrefix(rd, "/") && !strings.HasPrefix(rd, "//")
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, domain := range domains {
+		domain = strings.ToLower(domain)
+		if strings.HasPrefix(domain, ".") {
+			if strings.HasSuffix(host, domain) || host == domain[1:] {
+				return true
+			}
+		} else if host == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedURL フォワード認証のリクエストヘッダーから元のリクエストURLを組み立てます。
+func forwardedURL(r *http.Request) string {
+	uri := r.Header.Get("X-Forwarded-Uri")
+	if uri == "" {
+		return ""
+	}
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		return uri
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		proto = "https"
+	}
+	return proto + "://" + host + uri
+}
+
+// redirectDomains ログイン後の戻り先として許可するドメインを返します。
+// 許可リストに加えて、ログインURLへアクセスしたホストへの戻りを許可します。
+func (h *handler) redirectDomains(r *http.Request) []string {
+	domains := []string{}
+	if host := hostname(r.Host); host != "" {
+		domains = append(domains, host)
+	}
+	return append(domains, h.conf.AllowedRedirectDomains...)
+}
+
+func hostname(hostport string) string {
+	if u, err := url.Parse("//" + hostport); err == nil {
+		return u.Hostname()
+	}
+	return ""
+}
+
+// loginRequired 未ログインのリクエストに応答します。
+// リダイレクトする場合はログインURLへ、しない場合はLocationとWWW-Authenticate(RFC 6750)を付与して401を返します。
+// 元のリクエストURLはrdとしてログインURLへ付与し、ログインの認可リクエストと併せて保存されます。
+// challengeが空の場合はrealmのみのチャレンジを返します。
+func (h *handler) loginRequired(w http.ResponseWriter, r *http.Request, value proxyValue, session *sessions.Session, q url.Values, challenge string) {
+	conf := h.conf
+	q.Set("rd", r.URL.RequestURI())
+	if !h.shouldRedirect(r, value) {
+		if challenge == "" {
+			challenge = h.realmChallenge()
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+		UnAuthorizedResponse(w, conf.Login+"?"+q.Encode())
+		return
+	}
+	if preservable(r, value.location.PreserveRequest) {
+		var id string
+		err := saveSession(r, w, session, func(session *sessions.Session) {
+			id = saveRequest(r, value.location.PreserveRequest, session)
+		})
+		if err == nil && id != "" {
+			q.Set("rq", id)
+		}
+	}
+	status := http.StatusTemporaryRedirect
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// フォームの送信をログインURLへ再送させない
+		status = http.StatusSeeOther
+	}
+	http.Redirect(w, r, conf.Login+"?"+q.Encode(), status)
+}
+
+// realmChallenge トークンのエラーを含まないWWW-Authenticateのチャレンジを返します(RFC 6750)。
+func (h *handler) realmChallenge() string {
+	return fmt.Sprintf(`Bearer realm="%s"`, h.conf.ServerName)
+}
+
+// shouldRedirect 未ログインのリクエストをログインURLへリダイレクトするかを返します。
+func (h *handler) shouldRedirect(r *http.Request, value proxyValue) bool {
+	switch h.conf.GetUnauthenticated(value.location) {
+	case config.UnauthenticatedRedirect:
+		return true
+	case config.UnauthenticatedUnauthorized:
+		return false
+	}
+	if !isNavigation(r) {
+		return false
+	}
+	// 再送できるフォームの送信はGET以外でもリダイレクトする
+	return r.Method == http.MethodGet || r.Method == http.MethodHead || preservable(r, value.location.PreserveRequest)
+}
+
+// isNavigation ブラウザの画面遷移によるリクエストかを返します。
+// XHR/fetchのリクエストはリダイレクト先のIdPがCORSで拒否されるため対象外とします。
+func isNavigation(r *http.Request) bool {
+	if strings.EqualFold(r.Header.Get("X-Requested-With"), "XMLHttpRequest") {
+		return false
+	}
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" && mode != "navigate" {
+		return false
+	}
+	accept := r.Header.Get("Accept")
+	return !strings.Contains(accept, "application/json") || strings.Contains(accept, "text/html")
+}
@@ -0,0 +1,195 @@
+package routes
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+)
+
+// maxSavedRequests セッション毎に保持する中断したリクエストの上限
+const maxSavedRequests = 3
+
+// savedRequest セッション切れで中断したフォームの送信です。
+type savedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body"`
+	// Expires ログインが開始されなかった場合に破棄する時刻
+	Expires int64 `json:"expires"`
+}
+
+// preservedHeaders 再送のために保存するヘッダー
+var preservedHeaders = []string{"Content-Type"}
+
+// saveRequest 中断したフォームの送信をセッションへ保存し、ログインURLへ付与するIDを返します。
+// 対象外のリクエストやボディが上限を超える場合は保存せず、空文字を返します。
+func saveRequest(r *http.Request, conf config.PreserveRequest, session *sessions.Session) string {
+	if !preservable(r, conf) {
+		return ""
+	}
+	limit := conf.GetMaxBodySize()
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil || int64(len(body)) > limit {
+		return ""
+	}
+	id, err := randomValue()
+	if err != nil {
+		return ""
+	}
+	header := http.Header{}
+	for _, name := range preservedHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			header[name] = values
+		}
+	}
+	now := time.Now()
+	requests := savedRequests(session)
+	for key, req := range requests {
+		if now.Unix() >= req.Expires {
+			delete(requests, key)
+		}
+	}
+	for len(requests) >= maxSavedRequests {
+		var oldest string
+		for key, req := range requests {
+			if oldest == "" || req.Expires < requests[oldest].Expires {
+				oldest = key
+			}
+		}
+		delete(requests, oldest)
+	}
+	requests[id] = savedRequest{
+		Method:  r.Method,
+		URL:     r.URL.RequestURI(),
+		Header:  header,
+		Body:    string(body),
+		Expires: now.Add(pendingLoginTTL).Unix(),
+	}
+	session.Values["saved_requests"] = requests
+	return id
+}
+
+// preservable ログイン後に再送する対象のリクエストかを返します。
+func preservable(r *http.Request, conf config.PreserveRequest) bool {
+	if !conf.Enabled || r.Method != http.MethodPost {
+		return false
+	}
+	// 再送ページで再現できるのはURLエンコードされたフォームのみ
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/x-www-form-urlencoded" && sameOriginForm(r)
+}
+
+// sameOriginForm プロキシと同一オリジンのページから送信されたフォームかを返します。
+// 他のサイトから送信されたフォームを保存すると、ログイン後にプロキシのオリジンから再送され
+// SameSiteやOriginによるCSRF対策を回避できてしまうため、確認できない場合は対象外とします。
+func sameOriginForm(r *http.Request) bool {
+	if site := r.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin"
+	}
+	for _, name := range []string{"Origin", "Referer"} {
+		if value := r.Header.Get(name); value != "" {
+			u, err := url.Parse(value)
+			return err == nil && u.Host == r.Host
+		}
+	}
+	return false
+}
+
+func savedRequests(session *sessions.Session) map[string]savedRequest {
+	requests := map[string]savedRequest{}
+	sessionJSON(session, "saved_requests", &requests)
+	return requests
+}
+
+// takeSavedRequest 保存したリクエストを取り出します。戻り先と異なるURLのリクエストは再送しません。
+func takeSavedRequest(session *sessions.Session, id, redirect string) *savedRequest {
+	requests := savedRequests(session)
+	req, ok := requests[id]
+	delete(requests, id)
+	if len(requests) == 0 {
+		delete(session.Values, "saved_requests")
+	} else {
+		session.Values["saved_requests"] = requests
+	}
+	if !ok || req.URL != redirect || time.Now().Unix() >= req.Expires {
+		return nil
+	}
+	return &req
+}
+
+const replayPage = `<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Continue</title></head>
+<body>
+<p>ログイン前に送信したフォームを再送します。</p>
+<form method="{{.Method}}" action="{{.Action}}" enctype="{{.Enctype}}">
+{{- range .Fields}}
+<input type="hidden" name="{{.Name}}" value="{{.Value}}">
+{{- end}}
+<button type="submit">Continue</button>
+</form>
+</body></html>
+`
+
+var replayTemplate = template.Must(template.New("replay").Parse(replayPage))
+
+type replayField struct {
+	Name  string
+	Value string
+}
+
+// formFields URLエンコードされたボディを送信時の順序を保ったまま分解します。
+func formFields(body string) ([]replayField, error) {
+	var fields []replayField
+	for _, pair := range strings.Split(body, "&") {
+		if pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		name, err := url.QueryUnescape(kv[0])
+		if err != nil {
+			return nil, err
+		}
+		var value string
+		if len(kv) == 2 {
+			if value, err = url.QueryUnescape(kv[1]); err != nil {
+				return nil, err
+			}
+		}
+		fields = append(fields, replayField{Name: name, Value: value})
+	}
+	return fields, nil
+}
+
+// renderReplay 保存したフォームを再送する確認ページを返します。
+// 他のサイトが用意した送信をユーザーの操作なしに実行させないため、自動では送信しません。
+// ボディを再現できない場合は戻り先へリダイレクトします。
+func (h *handler) renderReplay(w http.ResponseWriter, r *http.Request, req *savedRequest) {
+	fields, err := formFields(req.Body)
+	if err != nil {
+		h.log.Warning(fmt.Sprintf("replay: %v", err))
+		http.Redirect(w, r, req.URL, http.StatusSeeOther)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	data := struct {
+		Method  string
+		Action  string
+		Enctype string
+		Fields  []replayField
+	}{req.Method, req.URL, mediaType, fields}
+	if err := replayTemplate.Execute(w, data); err != nil {
+		h.log.Error(err.Error())
+	}
+}
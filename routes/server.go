@@ -34,22 +34,71 @@ func (m MultiHost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Check リクエストのホストに対応するバーチャルサーバーで外部認可の判定を行います。
+func (m MultiHost) Check(r *http.Request) *CheckResult {
+	if handler := m[GetHostName(r)]; handler != nil {
+		return handler.Check(r)
+	}
+	return &CheckResult{
+		Status: http.StatusNotFound,
+	}
+}
+
+// Close 全てのバーチャルサーバーのハンドラーを破棄します。
+func (m MultiHost) Close() error {
+	var err error
+	for _, handler := range m {
+		if e := handler.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
 func New(configuration config.GetConfiguration) (Handler, error) {
 	conf := configuration()
 	router := new(conf)
+	chooser, err := providerChooser(conf)
+	if err != nil {
+		router.Close()
+		return nil, err
+	}
+	router.providerChooser = chooser
 	host := conf.GetHostname()
 	for _, location := range conf.Locations {
 		proxypasses := strings.Split(location.ProxyPass, ",")
 		registry, err := NewRegistry(proxypasses)
 		if err != nil {
+			router.Close()
 			return nil, err
 		}
 		for _, path := range location.Urls {
-			router.Proxy(path.Path, registry, host, path.Type, path.Token, location.IsProxySSLVerify())
+			router.Proxy(path.Path, registry, host, location, path)
 		}
 	}
 	router.Login(conf.Login)
 	router.Callback(conf.Callback)
 	router.Logout(conf.Logout)
+	if conf.PostLogout != "" {
+		router.PostLogout(conf.PostLogout)
+	}
+	if conf.BackchannelLogout != "" {
+		router.BackchannelLogout(conf.BackchannelLogout)
+	}
+	if conf.FrontchannelLogout != "" {
+		router.FrontchannelLogout(conf.FrontchannelLogout)
+	}
+	if conf.AuthCheck != "" {
+		router.AuthCheck(conf.AuthCheck)
+	}
+	if conf.Bff.UserInfo != "" {
+		router.BffUserInfo(conf.Bff.UserInfo)
+	}
+	if conf.Bff.Session != "" {
+		router.BffSession(conf.Bff.Session)
+	}
+	if conf.Bff.Token != "" {
+		router.BffToken(conf.Bff.Token)
+	}
 	return router, nil
 }
@@ -0,0 +1,80 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/auth"
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/config"
+	"golang.org/x/oauth2"
+)
+
+// stepUpOptions ログインURLのacr_values, max_ageを認可リクエストへ付与します。
+// コールバックで発行されたトークンを検証するため、要求した値を認可リクエストと併せて保存します。
+func stepUpOptions(q url.Values, login *pendingLogin) []oauth2.AuthCodeOption {
+	var opts []oauth2.AuthCodeOption
+	if acrValues := q.Get("acr_values"); acrValues != "" {
+		login.AcrValues = acrValues
+		opts = append(opts, oauth2.SetAuthURLParam("acr_values", acrValues))
+	}
+	if maxAge, err := strconv.Atoi(q.Get("max_age")); err == nil && maxAge > 0 {
+		login.MaxAge = maxAge
+		opts = append(opts, oauth2.SetAuthURLParam("max_age", strconv.Itoa(maxAge)))
+	}
+	if len(opts) > 0 {
+		// 既存のIdPのセッションを使用せずに再度認証させる
+		opts = append(opts, oauth2.SetAuthURLParam("prompt", "login"))
+	}
+	return opts
+}
+
+// verifyStepUp ログイン時に要求したacrとmax_ageを発行されたトークンが満たすかを検証します。
+// 満たさないトークンでセッションを更新すると、プロキシとログインの間でリダイレクトが繰り返されるためエラーとします。
+func verifyStepUp(login pendingLogin, claims auth.Claims) error {
+	return auth.CheckAuthentication(claims, strings.Fields(login.AcrValues), time.Duration(login.MaxAge)*time.Second)
+}
+
+// stepUpQuery パスが要求するacrとmax_ageをログインURLのクエリとして返します。
+func stepUpQuery(path config.Urls) url.Values {
+	q := url.Values{}
+	if len(path.Acr) > 0 {
+		q.Set("acr_values", strings.Join(path.Acr, " "))
+	}
+	if path.MaxAge > 0 {
+		q.Set("max_age", strconv.Itoa(path.MaxAge))
+	}
+	return q
+}
+
+// stepUp セッションの認証がパスの要求を満たさない場合に、acr_values, max_ageを付与して再度ログインさせます。
+// ログイン後は元のURLへ戻ります。
+func (h *handler) stepUp(w http.ResponseWriter, r *http.Request, value proxyValue, session *sessions.Session) {
+	q := stepUpQuery(value.url)
+	if len(h.providers) > 1 {
+		// 選択画面を表示せずにセッションのIdPで再認証する
+		q.Set("provider", h.sessionProvider(session).Name)
+	}
+	h.loginRequired(w, r, value, session, q, insufficientAuthenticationChallenge(value.url))
+}
+
+// insufficientAuthenticationResponse ベアラートークンの認証がパスの要求を満たさない場合のレスポンスです(RFC 9470)。
+func insufficientAuthenticationResponse(w http.ResponseWriter, path config.Urls) {
+	w.Header().Set("WWW-Authenticate", insufficientAuthenticationChallenge(path))
+	UnAuthorizedResponse(w, "")
+}
+
+func insufficientAuthenticationChallenge(path config.Urls) string {
+	challenge := `Bearer error="insufficient_user_authentication"`
+	if len(path.Acr) > 0 {
+		challenge += fmt.Sprintf(`, acr_values="%s"`, strings.Join(path.Acr, " "))
+	}
+	if path.MaxAge > 0 {
+		challenge += fmt.Sprintf(`, max_age=%d`, path.MaxAge)
+	}
+	return challenge
+}
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httputil"
+	"strconv"
 	"strings"
 
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/auth"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/internal"
 	"github.com/oidc-proxy-ecosystem/oidc-proxy/logger"
 )
@@ -102,3 +104,59 @@ func (a *AuthorizationTransaport) RoundTrip(r *http.Request) (*http.Response, er
 	r.Header.Set("Authorization", a.typ+" "+a.token)
 	return a.transport().RoundTrip(r)
 }
+
+// IdentityHeaderTransport クレームから生成したヘッダーをプロキシ先へ転送します。
+// クライアントが送信した同名のヘッダーは偽装を防ぐため必ず削除されます。
+type IdentityHeaderTransport struct {
+	Transport http.RoundTripper
+	headers   map[string]string
+	claims    auth.Claims
+}
+
+// NewIdentityHeaderTransport headersはヘッダー名からクレームへの対応です。
+func NewIdentityHeaderTransport(headers map[string]string, claims auth.Claims, transport http.RoundTripper) http.RoundTripper {
+	if len(headers) == 0 {
+		return transport
+	}
+	return &IdentityHeaderTransport{
+		Transport: transport,
+		headers:   headers,
+		claims:    claims,
+	}
+}
+
+func (t *IdentityHeaderTransport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+func (t *IdentityHeaderTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	for name, claim := range t.headers {
+		r.Header.Del(name)
+		if value, ok := claimHeaderValue(t.claims, claim); ok {
+			r.Header.Set(name, value)
+		}
+	}
+	return t.transport().RoundTrip(r)
+}
+
+func claimHeaderValue(claims auth.Claims, path string) (string, bool) {
+	v, ok := claims.Lookup(path)
+	if !ok || v == nil {
+		return "", false
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case []interface{}:
+		return strings.Join(claims.Strings(path), ","), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case map[string]interface{}:
+		return "", false
+	default:
+		return fmt.Sprint(v), true
+	}
+}
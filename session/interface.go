@@ -2,8 +2,12 @@ package session
 
 import (
 	"context"
+	"errors"
+	"time"
 )
 
+var ErrLockNotSupported = errors.New("session: lock is not supported")
+
 type Session interface {
 	Get(ctx context.Context, key string) (string, error)
 	Put(ctx context.Context, key string, value string) error
@@ -11,3 +15,13 @@ type Session interface {
 	Init(ctx context.Context, setting map[string]interface{}) error
 	Close(ctx context.Context) error
 }
+
+// Locker レプリカ間の排他制御に対応するセッションバックエンドが実装するフックです。
+// 複数のプロキシインスタンスが同じセッションのトークンを同時に更新しないために使用されます。
+type Locker interface {
+	// TryLock keyのロックを取得します。取得できた場合はUnlockに渡すトークンを返します。
+	// ロックはttlを過ぎると自動的に解放されます。
+	TryLock(ctx context.Context, key string, ttl time.Duration) (token string, ok bool, err error)
+	// Unlock TryLockで取得したロックを解放します。
+	Unlock(ctx context.Context, key string, token string) error
+}
@@ -127,12 +127,24 @@ func (store *SessionStore) save(session *sessions.Session) error {
 	if err != nil {
 		return err
 	}
+	if err := store.put("session_"+session.ID, encoded); err != nil {
+		return err
+	}
+	// インデックスの有効期限をセッションと併せて延長する
+	for _, indexKey := range Indexes(session) {
+		if err := store.refreshIndex(indexKey, session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *SessionStore) put(key, value string) error {
 	ctx, cancel := getCancelContext()
 	defer cancel()
 	store.StoreMutex.Lock()
 	defer store.StoreMutex.Unlock()
-	key := "session_" + session.ID
-	return store.session.Put(ctx, key, encoded)
+	return store.session.Put(ctx, key, value)
 }
 
 func (store *SessionStore) load(session *sessions.Session) error {
@@ -154,6 +166,50 @@ func (store *SessionStore) load(session *sessions.Session) error {
 	return nil
 }
 
+// Reload バックエンドに保存されている最新の値をセッションへ読み込みます。
+func (store *SessionStore) Reload(session *sessions.Session) error {
+	return store.load(session)
+}
+
+// Update Cookieを発行せずにバックエンドのセッションの値のみを更新します。
+func (store *SessionStore) Update(session *sessions.Session) error {
+	return store.save(session)
+}
+
+const lockRetryInterval = 50 * time.Millisecond
+
+// Lock セッションIDに対するレプリカ間のロックを取得し、解放する関数を返します。
+// バックエンドがsession.Lockerに対応していない場合はロックを行いません。
+func (store *SessionStore) Lock(ctx context.Context, id string, ttl time.Duration) (func(), error) {
+	noop := func() {}
+	locker, ok := store.session.(session.Locker)
+	if !ok {
+		return noop, nil
+	}
+	key := "lock_" + id
+	for {
+		token, locked, err := locker.TryLock(ctx, key, ttl)
+		if err == session.ErrLockNotSupported {
+			return noop, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if locked {
+			return func() {
+				ctx, cancel := getCancelContext()
+				defer cancel()
+				locker.Unlock(ctx, key, token)
+			}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
 func (store *SessionStore) Delete(session *sessions.Session) error {
 	ctx, cancel := getCancelContext()
 	defer cancel()
@@ -162,3 +218,165 @@ func (store *SessionStore) Delete(session *sessions.Session) error {
 	key := "session_" + session.ID
 	return store.session.Delete(ctx, key)
 }
+
+const indexLockTTL = 5 * time.Second
+
+// AddIndex indexKeyに紐づくセッションIDとしてsessionIDを登録します。
+// 既に削除されたセッションIDは登録時に取り除かれます。
+func (store *SessionStore) AddIndex(indexKey string, sessionID string) error {
+	ctx, cancel := getCancelContext()
+	defer cancel()
+	key := "index_" + indexKey
+	unlock, err := store.Lock(ctx, key, indexLockTTL)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	ids, err := store.getIndex(ctx, key)
+	if err != nil {
+		return err
+	}
+	live := []string{sessionID}
+	for _, id := range ids {
+		if id == sessionID {
+			continue
+		}
+		if value, err := store.session.Get(ctx, "session_"+id); err == nil && value != "" {
+			live = append(live, id)
+		}
+	}
+	buf, err := json.Marshal(live)
+	if err != nil {
+		return err
+	}
+	return store.session.Put(ctx, key, string(buf))
+}
+
+// indexesKey セッションを登録したインデックスを保持するセッションの値のキー
+const indexesKey = "indexes"
+
+// SetIndexes セッションを登録するインデックスを設定します。
+// バックエンドのインデックスはセッションを保存する度に有効期限が延長されます。
+func SetIndexes(session *sessions.Session, indexKeys []string) {
+	if len(indexKeys) == 0 {
+		delete(session.Values, indexesKey)
+		return
+	}
+	session.Values[indexesKey] = indexKeys
+}
+
+// Indexes セッションを登録したインデックスを返します。
+func Indexes(session *sessions.Session) []string {
+	switch v := session.Values[indexesKey].(type) {
+	case []string:
+		return v
+	case []interface{}:
+		// セッションストアはJSONで保存するため、読込後の値は[]interface{}になる
+		var indexKeys []string
+		for _, key := range v {
+			if key, ok := key.(string); ok {
+				indexKeys = append(indexKeys, key)
+			}
+		}
+		return indexKeys
+	}
+	return nil
+}
+
+// refreshIndex インデックスにセッションIDを登録し直し、バックエンドの有効期限を延長します。
+func (store *SessionStore) refreshIndex(indexKey string, sessionID string) error {
+	ctx, cancel := getCancelContext()
+	defer cancel()
+	key := "index_" + indexKey
+	unlock, err := store.Lock(ctx, key, indexLockTTL)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	ids, err := store.getIndex(ctx, key)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, id := range ids {
+		if id == sessionID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		ids = append(ids, sessionID)
+	}
+	buf, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	return store.session.Put(ctx, key, string(buf))
+}
+
+// RemoveIndex indexKeyに紐づくセッションIDからsessionIDを取り除きます。
+func (store *SessionStore) RemoveIndex(indexKey string, sessionID string) error {
+	ctx, cancel := getCancelContext()
+	defer cancel()
+	key := "index_" + indexKey
+	unlock, err := store.Lock(ctx, key, indexLockTTL)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	ids, err := store.getIndex(ctx, key)
+	if err != nil {
+		return err
+	}
+	var remain []string
+	for _, id := range ids {
+		if id != sessionID {
+			remain = append(remain, id)
+		}
+	}
+	if len(remain) == 0 {
+		return store.session.Delete(ctx, key)
+	}
+	buf, err := json.Marshal(remain)
+	if err != nil {
+		return err
+	}
+	return store.session.Put(ctx, key, string(buf))
+}
+
+// DeleteByIndex indexKeyに紐づく全てのセッションを削除し、削除したセッション数を返します。
+func (store *SessionStore) DeleteByIndex(indexKey string) (int, error) {
+	ctx, cancel := getCancelContext()
+	defer cancel()
+	key := "index_" + indexKey
+	unlock, err := store.Lock(ctx, key, indexLockTTL)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	ids, err := store.getIndex(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	deleted := 0
+	for _, id := range ids {
+		if err := store.session.Delete(ctx, "session_"+id); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, store.session.Delete(ctx, key)
+}
+
+func (store *SessionStore) getIndex(ctx context.Context, key string) ([]string, error) {
+	value, err := store.session.Get(ctx, key)
+	if err != nil || value == "" {
+		// 未登録のキーはバックエンドによってエラーとなるため空として扱う
+		return nil, nil
+	}
+	var ids []string
+	if err := json.Unmarshal([]byte(value), &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,88 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/gorilla/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordSession 書き込んだキーを記録するバックエンドです。
+type recordSession struct {
+	items map[string]string
+	puts  []string
+}
+
+func (s *recordSession) Get(ctx context.Context, key string) (string, error) {
+	return s.items[key], nil
+}
+
+func (s *recordSession) Put(ctx context.Context, key string, value string) error {
+	s.items[key] = value
+	s.puts = append(s.puts, key)
+	return nil
+}
+
+func (s *recordSession) Delete(ctx context.Context, key string) error {
+	delete(s.items, key)
+	return nil
+}
+
+func (s *recordSession) Init(ctx context.Context, setting map[string]interface{}) error {
+	return nil
+}
+
+func (s *recordSession) Close(ctx context.Context) error {
+	return nil
+}
+
+func TestSaveRefreshesIndexes(t *testing.T) {
+	backend := &recordSession{items: map[string]string{}}
+	store := NewStore(backend, []byte("something-very-secret"))
+	session := sessions.NewSession(store, "session")
+	session.ID = "session-id"
+	SetIndexes(session, []string{"sid_abc", "sub_user"})
+	if !assert.NoError(t, store.Update(session)) {
+		return
+	}
+
+	// 有効期限切れでインデックスが削除されても、セッションの保存時に登録し直す
+	delete(backend.items, "index_sid_abc")
+	backend.puts = nil
+	loaded := sessions.NewSession(store, "session")
+	loaded.ID = session.ID
+	if !assert.NoError(t, store.Reload(loaded)) {
+		return
+	}
+	assert.Equal(t, []string{"sid_abc", "sub_user"}, Indexes(loaded))
+	if !assert.NoError(t, store.Update(loaded)) {
+		return
+	}
+	assert.Equal(t, []string{"session_session-id", "index_sid_abc", "index_sub_user"}, backend.puts)
+	for _, key := range []string{"index_sid_abc", "index_sub_user"} {
+		var ids []string
+		assert.NoError(t, json.Unmarshal([]byte(backend.items[key]), &ids))
+		assert.Equal(t, []string{"session-id"}, ids)
+	}
+
+	// ログアウトしたセッションはインデックスから取り除く
+	other := sessions.NewSession(store, "session")
+	other.ID = "other-id"
+	SetIndexes(other, []string{"sub_user"})
+	if !assert.NoError(t, store.Update(other)) {
+		return
+	}
+	assert.NoError(t, store.RemoveIndex("sub_user", "other-id"))
+	var ids []string
+	assert.NoError(t, json.Unmarshal([]byte(backend.items["index_sub_user"]), &ids))
+	assert.Equal(t, []string{"session-id"}, ids)
+	assert.NoError(t, store.RemoveIndex("sub_user", "session-id"))
+	_, ok := backend.items["index_sub_user"]
+	assert.False(t, ok)
+
+	deleted, err := store.DeleteByIndex("sid_abc")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+}
@@ -55,12 +55,16 @@ func (cm *Watch) Load() error {
 	for _, conf := range appConf.Servers {
 		handler, err := routes.New(cm.GetConfiguration(conf.ServerName))
 		if err != nil {
+			multiHost.Close()
 			return err
 		}
 		multiHost[conf.GetHostname()] = handler
 		logger.Log.Info(fmt.Sprintf("Server listening on %s", conf.GetHostname()))
 	}
+	// 再読み込み前のハンドラーが保持しているプロバイダ情報のキャッシュを破棄
+	oldMultiHost := *cm.MultiHost
 	*cm.MultiHost = multiHost
+	oldMultiHost.Close()
 	return err
 }
 
@@ -0,0 +1,93 @@
+package key
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/oidc-proxy-ecosystem/oidc-proxy/watch"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+type Watch struct {
+	mu      sync.RWMutex
+	keyFile string
+	key     crypto.Signer
+}
+
+var _ watch.Watcher = &Watch{}
+
+func New(keyFile string) (*Watch, error) {
+	var err error
+	if !fileIsExists(keyFile) {
+		return nil, watch.ErrFileNotFound
+	}
+	keyFile, err = filepath.Abs(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Watch{
+		keyFile: keyFile,
+	}, nil
+}
+
+func (k *Watch) Watch(watcher *fsnotify.Watcher) error {
+	if err := watcher.Add(k.keyFile); err != nil {
+		return errors.Wrap(err, "keyファイルを監視出来ません。")
+	}
+	return nil
+}
+
+func (k *Watch) Load() error {
+	buf, err := ioutil.ReadFile(k.keyFile)
+	if err != nil {
+		return err
+	}
+	key, err := parsePrivateKey(buf)
+	if err == nil {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		k.key = key
+	}
+	return err
+}
+
+// PrivateKey 読み込んだ秘密鍵を返します。
+func (k *Watch) PrivateKey() crypto.Signer {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.key
+}
+
+// parsePrivateKey PKCS#8、PKCS#1(RSA)、SEC 1(EC)形式の秘密鍵を読み込みます。
+func parsePrivateKey(buf []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("PEM形式の秘密鍵が見つかりません。")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("署名に使用できない秘密鍵です。")
+		}
+		return signer, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("秘密鍵の形式が不正です。")
+}
+
+func fileIsExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}